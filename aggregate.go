@@ -0,0 +1,264 @@
+package sharding
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// aggregate is how a result column is combined across sharding tables.
+type aggregate struct {
+	// fn is one of count, sum, min, max and avg, empty for other columns.
+	fn string
+	// sum and count, the hidden `SUM(x)` and `COUNT(x)` columns of `AVG(x)`.
+	sum, count columnRef
+	// distinct, values is the hidden column of x for `COUNT(DISTINCT x)`,
+	// `SUM(DISTINCT x)` and `AVG(DISTINCT x)`, grouped by on the sharding tables.
+	distinct bool
+	values   columnRef
+}
+
+var aggregateFuncs = []string{"count", "sum", "min", "max", "avg"}
+
+// aggregateCall returns the aggregate function call of expr.
+func aggregateCall(expr sqlparser.Expr) (*sqlparser.Call, string, bool) {
+	call, ok := expr.(*sqlparser.Call)
+	if !ok || call.Name == nil {
+		return nil, "", false
+	}
+	fn := strings.ToLower(call.Name.Name)
+	for _, f := range aggregateFuncs {
+		if fn == f {
+			return call, fn, true
+		}
+	}
+	return nil, "", false
+}
+
+// hasAggregate returns whether there is an aggregate function call in expr.
+func hasAggregate(expr sqlparser.Expr) (found bool) {
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		if e, ok := node.(sqlparser.Expr); ok {
+			if _, _, ok := aggregateCall(e); ok {
+				found = true
+			}
+		}
+		return nil
+	}), expr)
+	return
+}
+
+// planAggregates plans how to combine the columns of the projection, when
+// there are aggregate functions or the groups are across sharding tables.
+// `AVG(x)` is computed from hidden `SUM(x)` and `COUNT(x)` columns, the
+// aggregate columns are not renamed, so they keep the names of the dialect.
+func (plan *mergePlan) planAggregates(rw *rewriter, stmt *sqlparser.SelectStatement, grouped bool) error {
+	if stmt.Columns == nil {
+		return nil
+	}
+
+	found := grouped
+	for _, column := range *stmt.Columns {
+		if column.Expr != nil && hasAggregate(column.Expr) {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	columns := *stmt.Columns
+	plan.aggregates = make([]aggregate, len(columns))
+	for i, column := range columns {
+		if column.Star {
+			return fmt.Errorf("SELECT * with aggregate functions is not supported for sharding tables")
+		}
+		if err := plan.planAggregate(rw, stmt, i, column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planAggregate plans how to combine the result column at index.
+func (plan *mergePlan) planAggregate(rw *rewriter, stmt *sqlparser.SelectStatement, index int, column *sqlparser.ResultColumn) error {
+	if !hasAggregate(column.Expr) {
+		return nil
+	}
+
+	call, fn, ok := aggregateCall(column.Expr)
+	if !ok {
+		return fmt.Errorf("aggregate expression %s is not supported for sharding tables", column.Expr.String())
+	}
+
+	plan.aggregates[index].fn = fn
+	if call.Distinct && fn != "min" && fn != "max" {
+		if len(call.Args) != 1 {
+			return fmt.Errorf("%s is not supported for sharding tables", call.String())
+		}
+		replace(rw, &stmt.GroupingElements, append(slices.Clone(stmt.GroupingElements), call.Args[0]))
+		plan.aggregates[index].distinct = true
+		plan.grouped = true
+		ref, err := plan.addHidden(rw, stmt, call.Args[0])
+		if err != nil {
+			return err
+		}
+		plan.aggregates[index].values = ref
+		return nil
+	}
+
+	if fn == "avg" {
+		sum, err := plan.addHidden(rw, stmt, &sqlparser.Call{Name: &sqlparser.Ident{Name: "SUM"}, Args: call.Args})
+		if err != nil {
+			return err
+		}
+		count, err := plan.addHidden(rw, stmt, &sqlparser.Call{Name: &sqlparser.Ident{Name: "COUNT"}, Args: call.Args})
+		if err != nil {
+			return err
+		}
+		plan.aggregates[index].sum, plan.aggregates[index].count = sum, count
+	}
+	return nil
+}
+
+// combine the rows of partial aggregates to one row.
+func (plan *mergePlan) combine(columns, types []string, rows [][]any) ([]any, error) {
+	result := make([]any, len(columns))
+	if len(rows) > 0 {
+		copy(result, rows[0])
+	}
+
+	for i, agg := range plan.aggregates {
+		index := i
+		if agg.distinct {
+			var err error
+			if index, err = agg.values.resolve(columns); err != nil {
+				return nil, err
+			}
+		}
+		values := make([]any, 0, len(rows))
+		for _, row := range rows {
+			values = append(values, row[index])
+		}
+		if agg.distinct {
+			values = distinctValues(values)
+		}
+
+		switch {
+		case agg.distinct && agg.fn == "count":
+			result[i] = int64(len(values))
+		case agg.distinct && agg.fn == "avg":
+			result[i] = nil
+			if sum, ok := toFloat(sumValues(values)); ok && len(values) > 0 {
+				result[i] = sum / float64(len(values))
+			}
+		case agg.fn == "count":
+			result[i] = sumValues(values)
+			if result[i] == nil {
+				result[i] = int64(0)
+			}
+		case agg.fn == "sum":
+			result[i] = sumValues(values)
+		case agg.fn == "min" || agg.fn == "max":
+			result[i] = nil
+			for _, v := range values {
+				if v == nil {
+					continue
+				}
+				if result[i] == nil {
+					result[i] = v
+					continue
+				}
+				c := compareResult(resultValue(v, types[i]), resultValue(result[i], types[i]))
+				if agg.fn == "min" && c < 0 || agg.fn == "max" && c > 0 {
+					result[i] = v
+				}
+			}
+		case agg.fn == "avg":
+			sumIndex, err := agg.sum.resolve(columns)
+			if err != nil {
+				return nil, fmt.Errorf("AVG: %w", err)
+			}
+			countIndex, err := agg.count.resolve(columns)
+			if err != nil {
+				return nil, fmt.Errorf("AVG: %w", err)
+			}
+			sums := make([]any, 0, len(rows))
+			counts := make([]any, 0, len(rows))
+			for _, row := range rows {
+				sums = append(sums, row[sumIndex])
+				counts = append(counts, row[countIndex])
+			}
+
+			s, _ := toFloat(normalizeResult(sumValues(sums)))
+			c, _ := toFloat(normalizeResult(sumValues(counts)))
+			if c == 0 {
+				result[i] = nil
+			} else {
+				result[i] = s / c
+			}
+		}
+	}
+	return result, nil
+}
+
+// distinctValues returns the distinct values which are not NULL. The number of
+// them is limited by distinctLimit when the rows are read.
+func distinctValues(values []any) []any {
+	seen := make(map[string]bool)
+	var result []any
+	for _, v := range values {
+		v = normalizeResult(v)
+		if v == nil {
+			continue
+		}
+		key := distinctKey([]any{v})
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, v)
+	}
+	return result
+}
+
+// sumValues returns the sum of values, int64 when all of them are integers,
+// otherwise float64. NULL values are skipped, the sum of NULL values is NULL.
+func sumValues(values []any) any {
+	var ints int64
+	var floats float64
+	isInt, isNull := true, true
+	for _, v := range values {
+		v = normalizeResult(v)
+		if v == nil {
+			continue
+		}
+		isNull = false
+		if i, ok := toInt(v); ok && isInt {
+			ints += i
+			floats += float64(i)
+		} else if f, ok := toFloat(v); ok {
+			isInt = false
+			floats += f
+		}
+	}
+
+	switch {
+	case isNull:
+		return nil
+	case isInt:
+		return ints
+	default:
+		return floats
+	}
+}
+
+// normalizeResult convert []byte returned by MySQL to string.
+func normalizeResult(v any) any {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
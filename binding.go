@@ -0,0 +1,61 @@
+package sharding
+
+import (
+	"fmt"
+
+	"github.com/longbridgeapp/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// Binding declares a group of binding tables, they are registered sharding
+// tables with the same sharding key and algorithm. A SELECT joining binding
+// tables is routed by the sharding key, and every table in the JOIN gets the
+// same suffix, so binding tables should be joined on the sharding key.
+//
+//	db.Use(sharding.Register(config, &Order{}, &OrderItem{}).Binding(&Order{}, &OrderItem{}))
+func (s *Sharding) Binding(tables ...any) *Sharding {
+	s._bindings = append(s._bindings, tables)
+	return s
+}
+
+func (s *Sharding) compileBindings() error {
+	s.bindings = make(map[string]int)
+	for group, tables := range s._bindings {
+		var first string
+		for _, table := range tables {
+			t, err := s.tableName(table)
+			if err != nil {
+				return err
+			}
+			c, ok := s.configs[t]
+			if !ok {
+				return fmt.Errorf("binding table %s is not a sharding table", t)
+			}
+			if _, ok := s.bindings[t]; ok {
+				return fmt.Errorf("binding table %s is in more than one binding group", t)
+			}
+
+			if first == "" {
+				first = t
+			} else {
+				fc := s.configs[first]
+				if !slices.Equal(c.shardingKeys(), fc.shardingKeys()) || !slices.Equal(c.ShardingSuffixs(), fc.ShardingSuffixs()) {
+					return fmt.Errorf("binding tables %s and %s should have the same sharding key and suffixs", first, t)
+				}
+			}
+			s.bindings[t] = group
+		}
+	}
+	return nil
+}
+
+// sourceTables returns the tables in FROM, subqueries in it are not included.
+func sourceTables(source sqlparser.Source) []*sqlparser.TableName {
+	switch source := source.(type) {
+	case *sqlparser.TableName:
+		return []*sqlparser.TableName{source}
+	case *sqlparser.JoinClause:
+		return append(sourceTables(source.X), sourceTables(source.Y)...)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package sharding
+
+import (
+	"fmt"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// Broadcast declares broadcast tables, they are small tables not sharded, like
+// `categories` or `currencies`, and replicated to every data source, so they
+// can be joined with sharding tables locally. Writes to broadcast tables are
+// executed on all data sources, reads are executed on any one of them, and
+// ShardingMigrator creates them on all data sources. The rows should be inserted
+// with ids, auto-increment ids may differ between data sources, and the rows
+// returned by INSERT ... RETURNING are of the first data source.
+//
+// A transaction is on the database of gorm DB only, so a write to broadcast
+// tables in it returns ErrCrossDataSourceTx when there are other data sources,
+// and nothing is written, unless two-phase commit is enabled.
+//
+//	db.Use(sharding.Register(config, &Order{}).Broadcast(&Category{}))
+func (s *Sharding) Broadcast(tables ...any) *Sharding {
+	s._broadcasts = append(s._broadcasts, tables...)
+	return s
+}
+
+func (s *Sharding) compileBroadcasts() error {
+	s.broadcasts = make(map[string]bool)
+	for _, table := range s._broadcasts {
+		t, err := s.tableName(table)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.configs[t]; ok {
+			return fmt.Errorf("broadcast table %s can not be a sharding table", t)
+		}
+		s.broadcasts[t] = true
+	}
+	return nil
+}
+
+// broadcastQueries returns the query for each data source.
+func (s *Sharding) broadcastQueries(query string, args []any) []shardQuery {
+	sources := s.dataSources()
+	stQueries := make([]shardQuery, 0, len(sources))
+	for _, source := range sources {
+		stQueries = append(stQueries, shardQuery{source: source, query: query, args: args, broadcast: true})
+	}
+	return stQueries
+}
+
+// hasShardingTable returns whether the statement references any sharding table.
+func (s *Sharding) hasShardingTable(stmt sqlparser.Statement) (found bool) {
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		if table, ok := node.(*sqlparser.TableName); ok && !found {
+			_, found = s.configs[table.Name.Name]
+		}
+		return nil
+	}), stmt)
+	return
+}
@@ -0,0 +1,453 @@
+package sharding
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// keyCondition is a `=`, `IN` or `= ANY` condition on the sharding key or id.
+type keyCondition struct {
+	expr   *sqlparser.BinaryExpr
+	y      sqlparser.Expr
+	isID   bool
+	values []any
+}
+
+// shardSet is the suffixes of the sharding tables a condition could match.
+type shardSet struct {
+	// byKey is false when the suffixes come from the id.
+	byKey    bool
+	suffixes []string
+	// rng is the range of sharding key the suffixes come from.
+	rng *Range
+}
+
+// conditionRouter routes a WHERE condition to sharding tables, by the conditions
+// on the sharding key or id, combined with AND and OR.
+type conditionRouter struct {
+	key  string
+	r    Config
+	args []any
+	// qualifiers, the table names or aliases a qualified column should refer to,
+	// any qualifier is accepted when it's empty.
+	qualifiers []string
+
+	// keys, the `=`, `IN` and `= ANY` conditions routed by.
+	keys   []*keyCondition
+	idFind bool
+}
+
+// nonInsertSuffixes returns the suffixes of the sharding tables the condition could match.
+func (s *Sharding) nonInsertSuffixes(r Config, qualifiers []string, condition sqlparser.Expr, args ...any) (suffixes []string, keys []*keyCondition, err error) {
+	cr := &conditionRouter{key: r.ShardingKey, r: r, args: args, qualifiers: qualifiers}
+	set, err := cr.route(condition)
+	if err != nil {
+		return nil, cr.keys, err
+	}
+	if len(r.ShardingKeys) > 0 {
+		composite, err := cr.compositeSet(condition)
+		if err != nil {
+			return nil, cr.keys, err
+		}
+		if set, err = cr.intersect(set, composite); err != nil {
+			return nil, cr.keys, err
+		}
+	}
+
+	if set == nil {
+		if cr.idFind && r.ShardingAlgorithmByPrimaryKey == nil {
+			return nil, cr.keys, errMissingPrimaryKeyAlgorithm
+		}
+		return nil, cr.keys, ErrMissingShardingKey
+	}
+
+	// The conditions can't be true at the same time, any sharding table returns nothing.
+	if len(set.suffixes) == 0 {
+		suffixs := r.ShardingSuffixs()
+		if len(suffixs) == 0 {
+			return nil, cr.keys, ErrMissingShardingKey
+		}
+		return suffixs[:1], cr.keys, nil
+	}
+
+	return set.suffixes, cr.keys, nil
+}
+
+// route returns nil when the condition doesn't restrict the sharding key or id.
+func (cr *conditionRouter) route(expr sqlparser.Expr) (*shardSet, error) {
+	switch n := expr.(type) {
+	case *sqlparser.ParenExpr:
+		return cr.route(n.X)
+	case *sqlparser.BinaryExpr:
+		switch n.Op {
+		case sqlparser.AND, sqlparser.OR:
+			x, err := cr.route(n.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := cr.route(n.Y)
+			if err != nil {
+				return nil, err
+			}
+			if n.Op == sqlparser.AND {
+				return cr.intersect(x, y)
+			}
+			return union(x, y), nil
+		}
+		return cr.compare(n)
+	}
+	return nil, nil
+}
+
+func (cr *conditionRouter) intersect(x, y *shardSet) (*shardSet, error) {
+	if x == nil {
+		return y, nil
+	}
+	if y == nil {
+		return x, nil
+	}
+
+	// The sharding key takes precedence over the id.
+	if x.byKey != y.byKey {
+		if x.byKey {
+			return x, nil
+		}
+		return y, nil
+	}
+
+	if x.rng != nil && y.rng != nil {
+		if rng, ok := x.rng.intersect(*y.rng); ok {
+			return cr.routeRange(rng)
+		}
+	}
+
+	set := &shardSet{byKey: x.byKey}
+	for _, suffix := range x.suffixes {
+		if slices.Contains(y.suffixes, suffix) {
+			set.suffixes = append(set.suffixes, suffix)
+		}
+	}
+	return set, nil
+}
+
+func union(x, y *shardSet) *shardSet {
+	if x == nil || y == nil {
+		return nil
+	}
+
+	set := &shardSet{byKey: x.byKey && y.byKey, suffixes: slices.Clone(x.suffixes)}
+	for _, suffix := range y.suffixes {
+		if !slices.Contains(set.suffixes, suffix) {
+			set.suffixes = append(set.suffixes, suffix)
+		}
+	}
+	return set
+}
+
+func (cr *conditionRouter) compare(n *sqlparser.BinaryExpr) (*shardSet, error) {
+	op, y := n.Op, n.Y
+	name, ok := cr.columnName(n.X)
+	if !ok {
+		// the column is on the right side, like `10 < user_id`
+		if name, ok = cr.columnName(n.Y); !ok {
+			return nil, nil
+		}
+		if op, ok = flipOp(op); !ok {
+			return nil, nil
+		}
+		y = n.X
+	}
+
+	switch y.(type) {
+	case *sqlparser.Ident, *sqlparser.QualifiedRef:
+		// compared with another column, like `orders.user_id = order_items.user_id`
+		return nil, nil
+	}
+	if hasSubquery(y) {
+		// compared with a subquery, like `user_id IN (SELECT ...)`
+		return nil, nil
+	}
+
+	switch {
+	case name == cr.key && (op == sqlparser.EQ || op == sqlparser.IN):
+		values, err := conditionValues(op, y, cr.args, keyValue)
+		if err != nil {
+			return nil, err
+		}
+		key := &keyCondition{expr: n, y: y, values: values}
+		cr.keys = append(cr.keys, key)
+		return cr.routeKey(key)
+	case name == "id" && (op == sqlparser.EQ || op == sqlparser.IN):
+		cr.idFind = true
+		if cr.r.ShardingAlgorithmByPrimaryKey == nil {
+			return nil, nil
+		}
+		values, err := conditionValues(op, y, cr.args, idValue)
+		if err != nil {
+			return nil, err
+		}
+		key := &keyCondition{expr: n, y: y, isID: true, values: values}
+		cr.keys = append(cr.keys, key)
+		return cr.routeKey(key)
+	case name == cr.key && op == sqlparser.IS && cr.r.NullKeyPolicy != NullKeyError:
+		if _, ok := y.(*sqlparser.NullLit); !ok {
+			return nil, nil
+		}
+		key := &keyCondition{expr: n, y: y, values: []any{nil}}
+		cr.keys = append(cr.keys, key)
+		return cr.routeKey(key)
+	case name == cr.key && cr.r.ShardingAlgorithmByRange != nil:
+		rng, ok := rangeOf(op, y, cr.args)
+		if !ok {
+			return nil, nil
+		}
+		return cr.routeRange(rng)
+	}
+	return nil, nil
+}
+
+func (cr *conditionRouter) routeKey(key *keyCondition) (*shardSet, error) {
+	set := &shardSet{byKey: !key.isID}
+	for _, value := range key.values {
+		suffix, err := conditionSuffix(key, value, cr.r)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(set.suffixes, suffix) {
+			set.suffixes = append(set.suffixes, suffix)
+		}
+	}
+	return set, nil
+}
+
+func (cr *conditionRouter) routeRange(rng Range) (*shardSet, error) {
+	suffixes, err := cr.r.ShardingAlgorithmByRange(rng)
+	if err != nil {
+		return nil, err
+	}
+	return &shardSet{byKey: true, suffixes: suffixes, rng: &rng}, nil
+}
+
+// rangeOf convert a `BETWEEN`, `<`, `<=`, `>` or `>=` condition to Range.
+func rangeOf(op sqlparser.Token, y sqlparser.Expr, args []any) (rng Range, ok bool) {
+	if op == sqlparser.BETWEEN {
+		between, ok := y.(*sqlparser.Range)
+		if !ok {
+			return rng, false
+		}
+		lower, err := keyValue(between.X, args)
+		if err != nil {
+			return rng, false
+		}
+		upper, err := keyValue(between.Y, args)
+		if err != nil {
+			return rng, false
+		}
+		return Range{Min: lower, MinInclusive: true, Max: upper, MaxInclusive: true}, true
+	}
+
+	v, err := keyValue(y, args)
+	if err != nil {
+		return rng, false
+	}
+	switch op {
+	case sqlparser.LT:
+		return Range{Max: v}, true
+	case sqlparser.LE:
+		return Range{Max: v, MaxInclusive: true}, true
+	case sqlparser.GT:
+		return Range{Min: v}, true
+	case sqlparser.GE:
+		return Range{Min: v, MinInclusive: true}, true
+	}
+	return rng, false
+}
+
+// flipOp returns the operator after swapping the operands.
+func flipOp(op sqlparser.Token) (sqlparser.Token, bool) {
+	switch op {
+	case sqlparser.EQ:
+		return sqlparser.EQ, true
+	case sqlparser.LT:
+		return sqlparser.GT, true
+	case sqlparser.LE:
+		return sqlparser.GE, true
+	case sqlparser.GT:
+		return sqlparser.LT, true
+	case sqlparser.GE:
+		return sqlparser.LE, true
+	}
+	return op, false
+}
+
+// columnName returns the column name of `column` or `table.column`.
+func (cr *conditionRouter) columnName(expr sqlparser.Expr) (string, bool) {
+	switch expr := expr.(type) {
+	case *sqlparser.Ident:
+		return expr.Name, true
+	case *sqlparser.QualifiedRef:
+		if expr.Star || expr.Column == nil {
+			return "", false
+		}
+		if len(cr.qualifiers) > 0 && (expr.Table == nil || !slices.Contains(cr.qualifiers, expr.Table.Name)) {
+			return "", false
+		}
+		return expr.Column.Name, true
+	}
+	return "", false
+}
+
+// conditionValues returns the values compared by `=`, `IN (...)` or `= ANY(...)`.
+func conditionValues(op sqlparser.Token, y sqlparser.Expr, args []any, value func(sqlparser.Expr, []any) (any, error)) ([]any, error) {
+	if op == sqlparser.IN {
+		list, ok := y.(*sqlparser.Exprs)
+		if !ok {
+			return nil, sqlparser.ErrNotImplemented
+		}
+		values := make([]any, 0, len(list.Exprs))
+		for _, expr := range list.Exprs {
+			v, err := value(expr, args)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+
+	if bind, ok := anyBind(y); ok {
+		return anyValues(args[bind.Pos], value)
+	}
+
+	v, err := value(y, args)
+	if err != nil {
+		return nil, err
+	}
+	return []any{v}, nil
+}
+
+func keyValue(expr sqlparser.Expr, args []any) (any, error) {
+	switch expr := expr.(type) {
+	case *sqlparser.BindExpr:
+		return args[expr.Pos], nil
+	case *sqlparser.StringLit:
+		return expr.Value, nil
+	case *sqlparser.NumberLit:
+		return expr.Value, nil
+	case *sqlparser.NullLit:
+		return nil, nil
+	case *sqlparser.UnaryExpr:
+		if n, ok := expr.X.(*sqlparser.NumberLit); ok && expr.Op == sqlparser.MINUS {
+			return "-" + n.Value, nil
+		}
+	}
+	return nil, sqlparser.ErrNotImplemented
+}
+
+func idValue(expr sqlparser.Expr, args []any) (any, error) {
+	switch expr := expr.(type) {
+	case *sqlparser.BindExpr:
+		id, ok := args[expr.Pos].(int64)
+		if !ok {
+			return nil, fmt.Errorf("ID should be int64 type")
+		}
+		return id, nil
+	case *sqlparser.NumberLit:
+		return strconv.ParseInt(expr.Value, 10, 64)
+	default:
+		return nil, ErrInvalidID
+	}
+}
+
+// anyBind match the PostgreSQL `= ANY($1)` array comparison.
+func anyBind(expr sqlparser.Expr) (*sqlparser.BindExpr, bool) {
+	call, ok := expr.(*sqlparser.Call)
+	if !ok || call.Name == nil || !strings.EqualFold(call.Name.Name, "any") || len(call.Args) != 1 {
+		return nil, false
+	}
+	bind, ok := call.Args[0].(*sqlparser.BindExpr)
+	return bind, ok
+}
+
+// anyValues returns the elements of an array argument of `= ANY($1)`.
+func anyValues(arg any, value func(sqlparser.Expr, []any) (any, error)) ([]any, error) {
+	rv := reflect.ValueOf(arg)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, sqlparser.ErrNotImplemented
+	}
+
+	values := make([]any, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		v, err := value(&sqlparser.BindExpr{Pos: 0}, []any{rv.Index(i).Interface()})
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func conditionSuffix(key *keyCondition, value any, r Config) (string, error) {
+	if key.isID {
+		return getSuffix(nil, value.(int64), false, r)
+	}
+	return getSuffix(value, 0, true, r)
+}
+
+// rewriteKeyConditions keeps only the values belong to suffix in the `IN` and
+// `= ANY` conditions, and returns the args for the rewritten query.
+func rewriteKeyConditions(rw *rewriter, stmt sqlparser.Statement, keys []*keyCondition, suffix string, r Config, args []any) ([]any, error) {
+	var compact bool
+	stArgs := args
+	for _, key := range keys {
+		if key.expr.Op == sqlparser.IN {
+			list := key.y.(*sqlparser.Exprs)
+			exprs := make([]sqlparser.Expr, 0, len(list.Exprs))
+			for i, value := range key.values {
+				subSuffix, err := conditionSuffix(key, value, r)
+				if err != nil {
+					return nil, err
+				}
+				if subSuffix == suffix {
+					exprs = append(exprs, list.Exprs[i])
+				} else if _, ok := list.Exprs[i].(*sqlparser.BindExpr); ok {
+					compact = true
+				}
+			}
+
+			if len(exprs) == 0 {
+				falseExpr(rw, key.expr)
+			} else {
+				replace(rw, &list.Exprs, exprs)
+			}
+		} else if bind, ok := anyBind(key.y); ok {
+			arg := reflect.ValueOf(stArgs[bind.Pos])
+			elems := reflect.MakeSlice(reflect.SliceOf(arg.Type().Elem()), 0, arg.Len())
+			for i, value := range key.values {
+				subSuffix, err := conditionSuffix(key, value, r)
+				if err != nil {
+					return nil, err
+				}
+				if subSuffix == suffix {
+					elems = reflect.Append(elems, arg.Index(i))
+				}
+			}
+			if arg.Kind() == reflect.Slice {
+				elems = elems.Convert(arg.Type())
+			}
+
+			stArgs = slices.Clone(stArgs)
+			stArgs[bind.Pos] = elems.Interface()
+		}
+	}
+
+	if compact {
+		stArgs = compactBinds(rw, stmt, stArgs)
+	}
+	return stArgs, nil
+}
@@ -3,6 +3,9 @@ package sharding
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
 
 	"gorm.io/gorm"
 )
@@ -12,6 +15,8 @@ type ConnPool struct {
 	// db, This is global db instance
 	sharding *Sharding
 	gorm.ConnPool
+	// options, routing options of the statement
+	options routeOptions
 }
 
 func (pool *ConnPool) String() string {
@@ -23,12 +28,12 @@ func (pool ConnPool) PrepareContext(ctx context.Context, query string) (*sql.Stm
 }
 
 func (pool ConnPool) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
-	ftQuery, stQuery, table, err := pool.sharding.resolve(query, args...)
+	ftQuery, stQueries, table, err := pool.sharding.resolve(pool.options, query, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	pool.sharding.querys.Store("last_query", stQuery)
+	pool.sharding.querys.Store("last_query", lastQuery(stQueries))
 
 	if table != "" {
 		if r, ok := pool.sharding.configs[table]; ok {
@@ -38,17 +43,48 @@ func (pool ConnPool) ExecContext(ctx context.Context, query string, args ...any)
 		}
 	}
 
-	return pool.ConnPool.ExecContext(ctx, stQuery, args...)
+	if len(stQueries) > 0 && stQueries[0].insert != nil {
+		if stQueries, err = pool.insertSelect(ctx, stQueries); err != nil {
+			return nil, err
+		}
+		if len(stQueries) == 0 {
+			return driver.RowsAffected(0), nil
+		}
+	}
+	if len(stQueries) > 0 && stQueries[0].move != nil {
+		return pool.moveRows(ctx, stQueries)
+	}
+
+	if len(stQueries) == 1 {
+		conn, err := pool.conn(stQueries[0].source)
+		if err != nil {
+			return nil, err
+		}
+		return conn.ExecContext(ctx, stQueries[0].query, stQueries[0].args...)
+	}
+
+	results := make(shardResults, len(stQueries))
+	err = pool.execute(ctx, stQueries, true, func(conn gorm.ConnPool, i int) (err error) {
+		results[i], err = conn.ExecContext(ctx, stQueries[i].query, stQueries[i].args...)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stQueries[0].broadcast {
+		return results[0], nil
+	}
+	return results, nil
 }
 
 // https://github.com/go-gorm/gorm/blob/v1.21.11/callbacks/query.go#L18
 func (pool ConnPool) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
-	ftQuery, stQuery, table, err := pool.sharding.resolve(query, args...)
+	ftQuery, stQueries, table, err := pool.sharding.resolve(pool.options, query, args...)
 	if err != nil {
 		return nil, err
 	}
 
-	pool.sharding.querys.Store("last_query", stQuery)
+	pool.sharding.querys.Store("last_query", lastQuery(stQueries))
 
 	if table != "" {
 		if r, ok := pool.sharding.configs[table]; ok {
@@ -58,18 +94,290 @@ func (pool ConnPool) QueryContext(ctx context.Context, query string, args ...any
 		}
 	}
 
-	return pool.ConnPool.QueryContext(ctx, stQuery, args...)
+	if len(stQueries) > 0 && stQueries[0].insert != nil {
+		if stQueries, err = pool.insertSelect(ctx, stQueries); err != nil {
+			return nil, err
+		}
+		if len(stQueries) == 0 {
+			return toRows(ctx, &resultSet{})
+		}
+	}
+	if len(stQueries) > 0 && stQueries[0].move != nil {
+		return nil, errMoveReturning
+	}
+
+	if len(stQueries) == 1 {
+		conn, err := pool.conn(stQueries[0].source)
+		if err != nil {
+			return nil, err
+		}
+		return conn.QueryContext(ctx, stQueries[0].query, stQueries[0].args...)
+	}
+
+	// INSERT ... RETURNING is executed in transaction
+	rs, err := pool.queryAll(ctx, stQueries, stQueries[0].rows != nil || stQueries[0].broadcast)
+	if err != nil {
+		return nil, err
+	}
+	return toRows(ctx, rs)
 }
 
 func (pool ConnPool) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
-	_, query, _, _ = pool.sharding.resolve(query, args...)
-	pool.sharding.querys.Store("last_query", query)
+	_, stQueries, _, err := pool.sharding.resolve(pool.options, query, args...)
+	if err != nil {
+		return toRow(ctx, nil, err)
+	}
+
+	pool.sharding.querys.Store("last_query", lastQuery(stQueries))
+
+	if len(stQueries) > 0 && stQueries[0].move != nil {
+		return toRow(ctx, nil, errMoveReturning)
+	}
+	if len(stQueries) > 0 && stQueries[0].insert != nil {
+		if stQueries, err = pool.insertSelect(ctx, stQueries); err != nil || len(stQueries) == 0 {
+			return toRow(ctx, &resultSet{}, err)
+		}
+	}
+
+	if len(stQueries) == 1 {
+		conn, connErr := pool.conn(stQueries[0].source)
+		if connErr != nil {
+			return toRow(ctx, nil, connErr)
+		}
+		return conn.QueryRowContext(ctx, stQueries[0].query, stQueries[0].args...)
+	}
+
+	rs, err := pool.queryAll(ctx, stQueries, false)
+	return toRow(ctx, rs, err)
+}
+
+// conn returns the connection of a data source. A statement in transaction
+// can only be executed on the database of the transaction.
+func (pool ConnPool) conn(source string) (gorm.ConnPool, error) {
+	if tx, ok := pool.ConnPool.(*distributedTx); ok && source != "" {
+		return tx.branch(source)
+	}
+	if source == "" {
+		return pool.ConnPool, nil
+	}
+	if _, ok := pool.ConnPool.(gorm.TxCommitter); ok {
+		return nil, ErrCrossDataSourceTx
+	}
+	db, ok := pool.sharding.sources[source]
+	if !ok {
+		return nil, fmt.Errorf("data source %s is not found", source)
+	}
+	return db.Statement.ConnPool, nil
+}
+
+// execute calls fn with the index of each query and the connection of its data
+// source. When tx is true, the queries of each data source are executed in one
+// transaction, but the transactions of data sources are committed one by one.
+// The connections of all data sources are got first, so none of the queries is
+// executed when one of them can't be, like ErrCrossDataSourceTx.
+func (pool ConnPool) execute(ctx context.Context, stQueries []shardQuery, tx bool, fn func(conn gorm.ConnPool, i int) error) error {
+	var sources []string
+	groups := make(map[string][]int)
+	conns := make(map[string]gorm.ConnPool)
+	for i, q := range stQueries {
+		if _, ok := groups[q.source]; !ok {
+			conn, err := pool.conn(q.source)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, q.source)
+			conns[q.source] = conn
+		}
+		groups[q.source] = append(groups[q.source], i)
+	}
+
+	for _, source := range sources {
+		indexes := groups[source]
+		run := func(conn gorm.ConnPool) error {
+			for _, i := range indexes {
+				if err := fn(conn, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		var err error
+		if tx {
+			err = inTx(ctx, conns[source], run)
+		} else {
+			err = run(conns[source])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return pool.ConnPool.QueryRowContext(ctx, query, args...)
+// inTx execute fn in the transaction of conn, or in a new transaction if conn
+// is not in a transaction.
+func inTx(ctx context.Context, conn gorm.ConnPool, fn func(conn gorm.ConnPool) error) error {
+	if _, ok := conn.(gorm.TxCommitter); ok {
+		return fn(conn)
+	}
+	if _, ok := conn.(*txBranch); ok {
+		return fn(conn)
+	}
+
+	beginner, ok := conn.(gorm.TxBeginner)
+	if !ok {
+		return fn(conn)
+	}
+
+	tx, err := beginner.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryAll execute the queries one by one, and buffer all rows of them.
+// The rows returned by INSERT are put back in the order of the original INSERT,
+// and the rows of SELECT are merged by the merge plan.
+func (pool ConnPool) queryAll(ctx context.Context, stQueries []shardQuery, tx bool) (*resultSet, error) {
+	var limit *distinctLimit
+	if plan := stQueries[0].merge; plan != nil {
+		limit = plan.distinctLimit()
+	}
+	shardSets := make([]*resultSet, len(stQueries))
+	err := pool.execute(ctx, stQueries, tx, func(conn gorm.ConnPool, i int) error {
+		rows, err := conn.QueryContext(ctx, stQueries[i].query, stQueries[i].args...)
+		if err != nil {
+			return err
+		}
+		shardSets[i], err = readResultSet(rows, limit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rs *resultSet
+	var ordered [][]any
+	sets := make([]*resultSet, 0, len(stQueries))
+	for i, q := range stQueries {
+		shardRs := shardSets[i]
+		if q.broadcast && i > 0 {
+			continue
+		}
+		if q.merge != nil {
+			sets = append(sets, shardRs)
+			continue
+		}
+
+		if q.rows != nil {
+			for i, row := range shardRs.rows {
+				if i < len(q.rows) {
+					for len(ordered) <= q.rows[i] {
+						ordered = append(ordered, nil)
+					}
+					ordered[q.rows[i]] = row
+				}
+			}
+			shardRs.rows = nil
+		}
+
+		if rs == nil {
+			rs = shardRs
+		} else if err := rs.append(shardRs); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(sets) > 0 {
+		return stQueries[0].merge.merge(sets)
+	}
+
+	for _, row := range ordered {
+		// less rows may return, like ON CONFLICT DO NOTHING
+		if row != nil {
+			rs.rows = append(rs.rows, row)
+		}
+	}
+	return rs, nil
+}
+
+// insertSelect executes the SELECT of INSERT ... SELECT, and returns the
+// INSERT queries of the rows selected.
+func (pool ConnPool) insertSelect(ctx context.Context, stQueries []shardQuery) ([]shardQuery, error) {
+	rs, err := pool.queryAll(ctx, stQueries, false)
+	if err != nil {
+		return nil, err
+	}
+	inserts, err := pool.sharding.insertQueries(stQueries[0].insert, rs)
+	if err != nil {
+		return nil, err
+	}
+	pool.sharding.querys.Store("last_query", lastQuery(append(stQueries, inserts...)))
+	return inserts, nil
+}
+
+func lastQuery(stQueries []shardQuery) string {
+	queries := make([]string, 0, len(stQueries))
+	for _, q := range stQueries {
+		queries = append(queries, q.query)
+	}
+	return strings.Join(queries, "; ")
+}
+
+// shardResults combine the results of the queries executed on sharding tables.
+type shardResults []sql.Result
+
+// LastInsertId returns the id generated by the only sharding table inserted to.
+// The ids generated by several sharding tables are not in order of the rows,
+// so an error is returned instead, and 0 when none generates ids.
+func (results shardResults) LastInsertId() (int64, error) {
+	var lastID int64
+	for _, result := range results {
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		if id != 0 && len(results) > 1 {
+			return 0, errMultiShardInsertID
+		}
+		lastID = id
+	}
+	return lastID, nil
+}
+
+func (results shardResults) RowsAffected() (int64, error) {
+	var total int64
+	for _, result := range results {
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
 }
 
 // BeginTx Implement ConnPoolBeginner.BeginTx
+// When two-phase commit is enabled with data sources, it begins a transaction
+// across data sources, which is a plain transaction until it has branches on
+// more than one data source.
 func (pool *ConnPool) BeginTx(ctx context.Context, opt *sql.TxOptions) (gorm.ConnPool, error) {
+	if _, ok := pool.ConnPool.(*distributedTx); ok {
+		// like *sql.Tx, a statement in the transaction doesn't begin another one
+		return nil, gorm.ErrInvalidTransaction
+	}
+	if _, inTx := pool.ConnPool.(gorm.TxCommitter); pool.sharding.distributed() && !inTx {
+		tx, err := pool.sharding.beginDistributedTx(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		return &ConnPool{ConnPool: tx, sharding: pool.sharding, options: pool.options}, nil
+	}
 	if basePool, ok := pool.ConnPool.(gorm.ConnPoolBeginner); ok {
 		return basePool.BeginTx(ctx, opt)
 	}
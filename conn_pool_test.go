@@ -0,0 +1,29 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+)
+
+type insertResult int64
+
+func (r insertResult) LastInsertId() (int64, error) { return int64(r), nil }
+func (r insertResult) RowsAffected() (int64, error) { return 1, nil }
+
+func TestShardResultsLastInsertId(t *testing.T) {
+	id, err := shardResults{insertResult(5)}.LastInsertId()
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(5), id)
+
+	// ids are not generated when they are inserted
+	id, err = shardResults{insertResult(0), insertResult(0)}.LastInsertId()
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(0), id)
+
+	_, err = shardResults{insertResult(5), insertResult(3)}.LastInsertId()
+	assert.Equal(t, errMultiShardInsertID, err)
+
+	n, _ := shardResults{insertResult(5), insertResult(3)}.RowsAffected()
+	assert.Equal(t, int64(2), n)
+}
@@ -0,0 +1,97 @@
+package sharding
+
+import (
+	"fmt"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+)
+
+// dataSources returns the names of all data sources, the database of the gorm
+// DB is the default data source, named "".
+func (s *Sharding) dataSources() []string {
+	names := map[string]bool{}
+	for _, c := range s.configs {
+		for name := range c.DataSources {
+			names[name] = true
+		}
+	}
+	delete(names, "")
+
+	sources := maps.Keys(names)
+	slices.Sort(sources)
+	return append([]string{""}, sources...)
+}
+
+// sourceDB returns the DB of a data source.
+func (s *Sharding) sourceDB(source string) *gorm.DB {
+	if db, ok := s.sources[source]; ok {
+		return db
+	}
+	return s.DB
+}
+
+// openDataSources connects to the data sources of all sharding tables.
+func (s *Sharding) openDataSources() error {
+	s.sources = make(map[string]*gorm.DB)
+	for _, c := range s.configs {
+		for name, dialector := range c.DataSources {
+			if _, ok := s.sources[name]; ok || name == "" {
+				continue
+			}
+			db, err := gorm.Open(dialector, &gorm.Config{
+				Logger:                                   s.DB.Logger,
+				NamingStrategy:                           s.DB.NamingStrategy,
+				DisableForeignKeyConstraintWhenMigrating: s.DB.DisableForeignKeyConstraintWhenMigrating,
+			})
+			if err != nil {
+				return fmt.Errorf("open data source %s error, %w", name, err)
+			}
+			s.sources[name] = db
+		}
+	}
+	return nil
+}
+
+// dataSource returns the data source of the sharding table with suffix.
+func dataSource(r Config, suffix string) (string, error) {
+	if r.DataSourceAlgorithm == nil {
+		return "", nil
+	}
+	source, err := r.DataSourceAlgorithm(suffix)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := r.DataSources[source]; !ok && source != "" {
+		return "", fmt.Errorf("data source %s of suffix %s is not in DataSources", source, suffix)
+	}
+	return source, nil
+}
+
+// scopesSource returns the data source of the sharding tables in all scopes,
+// they should be in the same data source.
+func scopesSource(scopes []*scope) (string, error) {
+	var source string
+	var found bool
+	for _, sc := range scopes {
+		if len(sc.tables) == 0 {
+			continue
+		}
+		suffixes := []string{sc.suffix}
+		if sc.union {
+			suffixes = sc.suffixes
+		}
+		for _, suffix := range suffixes {
+			s, err := dataSource(sc.r, suffix)
+			if err != nil {
+				return "", err
+			}
+			if found && s != source {
+				return "", ErrCrossDataSource
+			}
+			source, found = s, true
+		}
+	}
+	return source, nil
+}
@@ -43,13 +43,14 @@ func (m ShardingMigrator) AutoMigrate(dst ...any) error {
 
 	stmt := &gorm.Statement{DB: m.sharding.DB}
 	for _, sd := range shardingDsts {
-		tx := stmt.DB.Session(&gorm.Session{}).Table(sd.table)
+		tx := m.sharding.sourceDB(sd.source).Session(&gorm.Session{}).Table(sd.table)
 		if err := m.dialector.Migrator(tx).AutoMigrate(sd.dst); err != nil {
 			return err
 		}
 
 	}
 
+	noShardingDsts, broadcastDsts := m.splitBroadcastDsts(noShardingDsts)
 	if len(noShardingDsts) > 0 {
 		tx := stmt.DB.Session(&gorm.Session{})
 		tx.Statement.Settings.Store(ShardingIgnoreStoreKey, nil)
@@ -60,6 +61,19 @@ func (m ShardingMigrator) AutoMigrate(dst ...any) error {
 		}
 	}
 
+	// broadcast tables are created on all data sources
+	if len(broadcastDsts) > 0 {
+		for _, source := range m.sharding.dataSources() {
+			tx := m.sharding.sourceDB(source).Session(&gorm.Session{})
+			tx.Statement.Settings.Store(ShardingIgnoreStoreKey, nil)
+			err := m.dialector.Migrator(tx).AutoMigrate(broadcastDsts...)
+			tx.Statement.Settings.Delete(ShardingIgnoreStoreKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -75,23 +89,56 @@ func (m ShardingMigrator) DropTable(dst ...any) error {
 	}
 
 	for _, sd := range shardingDsts {
-		if err := m.Migrator.DropTable(sd.table); err != nil {
+		if sd.source == "" {
+			if err := m.Migrator.DropTable(sd.table); err != nil {
+				return err
+			}
+			continue
+		}
+		tx := m.sharding.sourceDB(sd.source).Session(&gorm.Session{})
+		if err := m.dialector.Migrator(tx).DropTable(sd.table); err != nil {
 			return err
 		}
 	}
 
+	noShardingDsts, broadcastDsts := m.splitBroadcastDsts(noShardingDsts)
 	if len(noShardingDsts) > 0 {
 		if err := m.Migrator.DropTable(noShardingDsts...); err != nil {
 			return err
 		}
 	}
 
+	if len(broadcastDsts) > 0 {
+		for _, source := range m.sharding.dataSources() {
+			tx := m.sharding.sourceDB(source).Session(&gorm.Session{})
+			if err := m.dialector.Migrator(tx).DropTable(broadcastDsts...); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
+// splitBroadcastDsts splits broadcast dsts from normal dsts
+func (m ShardingMigrator) splitBroadcastDsts(dsts []any) (noShardingDsts, broadcastDsts []any) {
+	noShardingDsts = make([]any, 0, len(dsts))
+	for _, model := range dsts {
+		stmt := &gorm.Statement{DB: m.sharding.DB}
+		if err := stmt.Parse(model); err == nil && m.sharding.broadcasts[stmt.Table] {
+			broadcastDsts = append(broadcastDsts, model)
+		} else {
+			noShardingDsts = append(noShardingDsts, model)
+		}
+	}
+	return
+}
+
 type shardingDst struct {
 	table string
 	dst   any
+	// source, the data source the sharding table is in.
+	source string
 }
 
 // splite sharding or normal dsts
@@ -116,10 +163,16 @@ func (m ShardingMigrator) splitShardingDsts(dsts ...any) (shardingDsts []shardin
 			}
 
 			for _, suffix := range suffixs {
+				var source string
+				source, err = dataSource(cfg, suffix)
+				if err != nil {
+					return
+				}
 				shardingTable := stmt.Table + suffix
 				shardingDsts = append(shardingDsts, shardingDst{
-					table: shardingTable,
-					dst:   model,
+					table:  shardingTable,
+					dst:    model,
+					source: source,
 				})
 			}
 
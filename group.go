@@ -0,0 +1,199 @@
+package sharding
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// groupsByKey returns whether all columns of the sharding key are in the GROUP
+// BY expressions, so every group is in one sharding table.
+func groupsByKey(exprs []sqlparser.Expr, keys []string) bool {
+	for _, key := range keys {
+		var found bool
+		for _, expr := range exprs {
+			if name, ok := refColumn(expr); ok && name == key {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// hasBind returns whether there is a bind parameter in expr.
+func hasBind(expr sqlparser.Expr) (found bool) {
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		if _, ok := node.(*sqlparser.BindExpr); ok {
+			found = true
+		}
+		return nil
+	}), expr)
+	return
+}
+
+// planHaving maps the columns in HAVING to the result columns, they are added
+// as hidden columns when not selected. Each aggregate function is added as a
+// hidden column, a selected one may be changed by combine before HAVING.
+func (plan *mergePlan) planHaving(rw *rewriter, stmt *sqlparser.SelectStatement, expr sqlparser.Expr) error {
+	switch n := expr.(type) {
+	case *sqlparser.ParenExpr:
+		return plan.planHaving(rw, stmt, n.X)
+	case *sqlparser.BinaryExpr:
+		if err := plan.planHaving(rw, stmt, n.X); err != nil {
+			return err
+		}
+		return plan.planHaving(rw, stmt, n.Y)
+	case *sqlparser.Call:
+		if _, _, ok := aggregateCall(n); !ok {
+			break
+		}
+		ref, err := plan.addHidden(rw, stmt, n)
+		if err != nil {
+			return err
+		}
+		plan.havingRefs[n] = ref
+		return nil
+	case *sqlparser.Ident, *sqlparser.QualifiedRef:
+		ref, err := plan.resultColumn(rw, stmt, n)
+		if err != nil {
+			return err
+		}
+		plan.havingRefs[n] = ref
+		return nil
+	case *sqlparser.NumberLit, *sqlparser.StringLit, *sqlparser.NullLit, *sqlparser.BindExpr:
+		return nil
+	}
+	return fmt.Errorf("HAVING %s is not supported for sharding tables", expr.String())
+}
+
+// regroup merges the groups returned by the sharding tables, and filters them
+// by HAVING. The groups are in order of first appearance.
+func (plan *mergePlan) regroup(columns, types []string, rows [][]any) ([][]any, error) {
+	indexes := make([]int, 0, len(plan.groupBy))
+	for _, ref := range plan.groupBy {
+		index, err := ref.resolve(columns)
+		if err != nil {
+			return nil, fmt.Errorf("GROUP BY: %w", err)
+		}
+		indexes = append(indexes, index)
+	}
+
+	var keys []string
+	groups := make(map[string][][]any)
+	for _, row := range rows {
+		values := make([]any, 0, len(indexes))
+		for _, index := range indexes {
+			values = append(values, row[index])
+		}
+		key := distinctKey(values)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], row)
+	}
+
+	// aggregate functions without GROUP BY always return one row
+	if len(plan.groupBy) == 0 && len(keys) == 0 {
+		keys = append(keys, "")
+	}
+
+	result := make([][]any, 0, len(keys))
+	for _, key := range keys {
+		row, err := plan.combine(columns, types, groups[key])
+		if err != nil {
+			return nil, err
+		}
+		if plan.having != nil {
+			v, err := plan.eval(plan.having, columns, types, row)
+			if err != nil {
+				return nil, err
+			}
+			if b, _ := v.(bool); !b {
+				continue
+			}
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+// distinctKey returns a key of values, equal values have the same key.
+func distinctKey(values []any) string {
+	normalized := make([]any, 0, len(values))
+	for _, v := range values {
+		normalized = append(normalized, normalizeResult(v))
+	}
+	return fmt.Sprintf("%#v", normalized)
+}
+
+// eval evaluates a HAVING expression on a merged row, NULL is returned as nil
+// and treated as false.
+func (plan *mergePlan) eval(expr sqlparser.Expr, columns, types []string, row []any) (any, error) {
+	if ref, ok := plan.havingRefs[expr]; ok {
+		index, err := ref.resolve(columns)
+		if err != nil {
+			return nil, fmt.Errorf("HAVING: %w", err)
+		}
+		return resultValue(row[index], types[index]), nil
+	}
+
+	switch n := expr.(type) {
+	case *sqlparser.ParenExpr:
+		return plan.eval(n.X, columns, types, row)
+	case *sqlparser.NumberLit:
+		if i, err := strconv.ParseInt(n.Value, 10, 64); err == nil {
+			return i, nil
+		}
+		return strconv.ParseFloat(n.Value, 64)
+	case *sqlparser.StringLit:
+		return n.Value, nil
+	case *sqlparser.NullLit:
+		return nil, nil
+	case *sqlparser.BindExpr:
+		return plan.args[n.Pos], nil
+	case *sqlparser.BinaryExpr:
+		x, err := plan.eval(n.X, columns, types, row)
+		if err != nil {
+			return nil, err
+		}
+		y, err := plan.eval(n.Y, columns, types, row)
+		if err != nil {
+			return nil, err
+		}
+
+		switch n.Op {
+		case sqlparser.AND:
+			a, _ := x.(bool)
+			b, _ := y.(bool)
+			return a && b, nil
+		case sqlparser.OR:
+			a, _ := x.(bool)
+			b, _ := y.(bool)
+			return a || b, nil
+		}
+
+		if x == nil || y == nil {
+			return nil, nil
+		}
+		c := compareResult(x, y)
+		switch n.Op {
+		case sqlparser.EQ:
+			return c == 0, nil
+		case sqlparser.NE:
+			return c != 0, nil
+		case sqlparser.LT:
+			return c < 0, nil
+		case sqlparser.LE:
+			return c <= 0, nil
+		case sqlparser.GT:
+			return c > 0, nil
+		case sqlparser.GE:
+			return c >= 0, nil
+		}
+	}
+	return nil, fmt.Errorf("HAVING %s is not supported for sharding tables", expr.String())
+}
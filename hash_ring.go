@@ -0,0 +1,94 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// HashRing is the built-in consistent hashing algorithm. Every sharding table
+// owns VirtualNodes points on a hash ring, and a value is routed to the table
+// of the first point after its hash, so adding a table only moves about 1/N
+// of the rows to it, not almost all of them like `id % NumberOfShards`.
+//
+//	sharding.Config{
+//		ShardingKey:    "user_id",
+//		NumberOfShards: 8,
+//		HashRing:       &sharding.HashRing{VirtualNodes: 200},
+//	}
+type HashRing struct {
+	// Suffixs is the suffixes of the sharding tables, defaults to the tables of
+	// NumberOfShards, like _0, _1 ... _7.
+	Suffixs []string
+	// VirtualNodes is the number of points of every table, defaults to 160.
+	VirtualNodes int
+	// Hash is the hash function of values and points, defaults to crc32.ChecksumIEEE.
+	Hash func(data []byte) uint32
+
+	points []uint32
+	owners map[uint32]string
+}
+
+func (h *HashRing) compile() error {
+	if len(h.Suffixs) == 0 {
+		return errors.New("HashRing Suffixs or NumberOfShards is required")
+	}
+	if h.VirtualNodes == 0 {
+		h.VirtualNodes = 160
+	}
+	if h.Hash == nil {
+		h.Hash = crc32.ChecksumIEEE
+	}
+
+	h.points = make([]uint32, 0, len(h.Suffixs)*h.VirtualNodes)
+	h.owners = make(map[uint32]string, len(h.Suffixs)*h.VirtualNodes)
+	seen := make(map[string]bool, len(h.Suffixs))
+	for _, suffix := range h.Suffixs {
+		if seen[suffix] {
+			return fmt.Errorf("HashRing suffix %s is duplicated", suffix)
+		}
+		seen[suffix] = true
+		for i := 0; i < h.VirtualNodes; i++ {
+			point := h.Hash([]byte(suffix + "#" + strconv.Itoa(i)))
+			// a point of two tables belongs to the first one
+			if _, ok := h.owners[point]; ok {
+				continue
+			}
+			h.owners[point] = suffix
+			h.points = append(h.points, point)
+		}
+	}
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i] < h.points[j] })
+	return nil
+}
+
+// ShardingAlgorithm returns the suffix of the table owns the hash of value.
+func (h *HashRing) ShardingAlgorithm(value any) (suffix string, err error) {
+	value, err = normalizeKey(value)
+	if err != nil {
+		return "", err
+	}
+	var key string
+	switch value := value.(type) {
+	case nil:
+		return "", errors.New("HashRing can not route a nil value")
+	case CompositeKey:
+		key = fmt.Sprintf("%v", []any(value))
+	default:
+		key = fmt.Sprint(value)
+	}
+
+	hash := h.Hash([]byte(key))
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= hash })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]], nil
+}
+
+// ShardingSuffixs returns the suffixes of all sharding tables.
+func (h *HashRing) ShardingSuffixs() (suffixs []string) {
+	return h.Suffixs
+}
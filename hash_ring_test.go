@@ -0,0 +1,79 @@
+package sharding
+
+import (
+	"hash/fnv"
+	"testing"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/longbridgeapp/assert"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := &HashRing{Suffixs: []string{"_0", "_1", "_2", "_3"}}
+	assert.Equal[error](t, nil, ring.compile())
+	assert.Equal(t, []string{"_0", "_1", "_2", "_3"}, ring.ShardingSuffixs())
+
+	// the same value of different types is in the same table
+	suffix, err := ring.ShardingAlgorithm(int64(101))
+	assert.Equal[error](t, nil, err)
+	suffix2, _ := ring.ShardingAlgorithm("101")
+	assert.Equal(t, suffix, suffix2)
+
+	// adding a table only moves the values to it
+	grown := &HashRing{Suffixs: []string{"_0", "_1", "_2", "_3", "_4"}}
+	assert.Equal[error](t, nil, grown.compile())
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		before, _ := ring.ShardingAlgorithm(i)
+		after, _ := grown.ShardingAlgorithm(i)
+		if before != after {
+			assert.Equal(t, "_4", after)
+			moved++
+		}
+	}
+	assert.Equal(t, true, moved > 1000 && moved < 3000)
+
+	fnv32 := func(data []byte) uint32 {
+		h := fnv.New32a()
+		h.Write(data)
+		return h.Sum32()
+	}
+	ring = &HashRing{Suffixs: []string{"_a", "_b"}, VirtualNodes: 10, Hash: fnv32}
+	assert.Equal[error](t, nil, ring.compile())
+	assert.Equal(t, 20, len(ring.points))
+
+	ring = &HashRing{Suffixs: []string{"_a", "_a"}}
+	assert.NotEqual[error](t, nil, ring.compile())
+}
+
+func TestHashRingConfig(t *testing.T) {
+	s := Register(Config{
+		ShardingKey:         "user_id",
+		NumberOfShards:      4,
+		HashRing:            &HashRing{},
+		PrimaryKeyGenerator: PKSnowflake,
+	}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+	assert.Equal(t, []string{"_0", "_1", "_2", "_3"}, s.configs["orders"].ShardingSuffixs())
+	suffix, _ := s.configs["orders"].ShardingAlgorithm(int64(101))
+	expected, _ := s.configs["orders"].HashRing.ShardingAlgorithm(int64(101))
+	assert.Equal(t, expected, suffix)
+}
+
+func TestHashRingPrimaryKey(t *testing.T) {
+	s := Register(Config{
+		ShardingKey:         "user_id",
+		HashRing:            &HashRing{Suffixs: []string{"_00", "_01", "_02"}},
+		PrimaryKeyGenerator: PKSnowflake,
+	}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+
+	// the node is the position of the suffix in Suffixs
+	r := s.configs["orders"]
+	index, err := r.suffixIndex("_02")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(2), index)
+
+	node, _ := snowflake.NewNode(index)
+	assert.Equal(t, "_02", r.ShardingAlgorithmByPrimaryKey(node.Generate().Int64()))
+}
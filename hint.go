@@ -0,0 +1,84 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Hint forces the sharding tables a statement is routed to, instead of the
+// conditions of the sharding key. Use it with gorm Clauses.
+//
+//	db.Clauses(sharding.Shard("_03")).Where("product", "iPad").Find(&orders)
+//	db.Clauses(sharding.AllShards()).Where("product", "iPad").Delete(&Order{})
+//	db.Clauses(sharding.ByKey(uid)).Where("product", "iPad").Find(&orders)
+type Hint struct {
+	suffix string
+	all    bool
+	key    any
+}
+
+// Shard routes the statement to the sharding tables of suffix.
+func Shard(suffix string) Hint {
+	return Hint{suffix: suffix}
+}
+
+// AllShards routes the statement to all sharding tables.
+func AllShards() Hint {
+	return Hint{all: true}
+}
+
+// ByKey routes the statement to the sharding tables of the sharding key value,
+// several values are a CompositeKey.
+func ByKey(values ...any) Hint {
+	if len(values) == 1 {
+		return Hint{key: values[0]}
+	}
+	return Hint{key: CompositeKey(values)}
+}
+
+// ModifyStatement implements gorm StatementModifier, the hint is stored to
+// the statement by ShardingHintStoreKey.
+func (h Hint) ModifyStatement(stmt *gorm.Statement) {
+	stmt.Settings.Store(ShardingHintStoreKey, h)
+}
+
+// Build implements clause.Expression, the hint builds nothing.
+func (h Hint) Build(clause.Builder) {}
+
+// suffixes returns the suffixes of the sharding tables of r.
+func (h Hint) suffixes(r Config) ([]string, error) {
+	switch {
+	case h.all:
+		suffixes := r.ShardingSuffixs()
+		if len(suffixes) == 0 {
+			return nil, errors.New("sharding table suffixs is empty")
+		}
+		return suffixes, nil
+	case h.key != nil:
+		suffix, err := r.ShardingAlgorithm(h.key)
+		if err != nil {
+			return nil, err
+		}
+		return []string{suffix}, nil
+	}
+	if !slices.Contains(r.ShardingSuffixs(), h.suffix) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSuffix, h.suffix)
+	}
+	return []string{h.suffix}, nil
+}
+
+// insertSuffix returns the suffix of the sharding table to insert into.
+func (h Hint) insertSuffix(r Config) (string, error) {
+	if h.all {
+		return "", errors.New("can not insert into all sharding tables")
+	}
+	suffixes, err := h.suffixes(r)
+	if err != nil {
+		return "", err
+	}
+	return suffixes[0], nil
+}
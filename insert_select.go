@@ -0,0 +1,143 @@
+package sharding
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// maxInsertBinds is the max number of bind parameters of one INSERT, the rows
+// of INSERT ... SELECT are inserted in batches under it.
+const maxInsertBinds = 65535
+
+// insertSelect is the plan of INSERT ... SELECT which touches sharding tables.
+// The SELECT is executed first, then its rows are inserted into the sharding
+// tables of their sharding key, like INSERT ... VALUES.
+type insertSelect struct {
+	stmt   *sqlparser.InsertStatement
+	upsert *mysqlUpsert
+	// args, the args of the original query.
+	args []any
+	opts routeOptions
+	// dollar, whether the bind parameters are like `$1`, or `?`.
+	dollar bool
+}
+
+// resolveInsertSelect returns the queries of the SELECT of an INSERT ... SELECT,
+// which carry the plan to insert the rows. The query is not changed when
+// neither the table inserted into nor the tables selected from are sharded.
+func (s *Sharding) resolveInsertSelect(opts routeOptions, stmt *sqlparser.InsertStatement, upsert *mysqlUpsert, query string, args ...any) (ftQuery string, stQueries []shardQuery, tableName string, err error) {
+	ftQuery = query
+	stQueries = []shardQuery{{query: query, args: args}}
+	tableName = stmt.TableName.Name.Name
+
+	rw := &rewriter{}
+	selectArgs := compactBinds(rw, stmt.Query, args)
+	selectQuery := stmt.Query.String()
+	rw.restore()
+
+	_, selects, _, err := s.resolve(opts, selectQuery, selectArgs...)
+	if err != nil {
+		return
+	}
+	r, sharded := s.configs[tableName]
+	if !sharded && len(selects) == 1 && selects[0].source == "" && selects[0].query == selectQuery {
+		return
+	}
+	if sharded {
+		if err = checkUpsert(r, stmt, upsert); err != nil {
+			return
+		}
+	}
+	if upsert != nil {
+		upsert.binds = bindCount(stmt)
+	}
+
+	plan := &insertSelect{stmt: stmt, upsert: upsert, args: args, opts: opts, dollar: s.dollarBinds(stmt)}
+	for i := range selects {
+		selects[i].insert = plan
+	}
+	return ftQuery, selects, tableName, nil
+}
+
+// insertQueries returns the INSERT queries of the rows selected by the plan.
+func (s *Sharding) insertQueries(plan *insertSelect, rs *resultSet) (stQueries []shardQuery, err error) {
+	columns := plan.stmt.ColumnNames
+	if len(columns) == 0 {
+		for _, name := range rs.columns {
+			columns = append(columns, &sqlparser.Ident{Name: name})
+		}
+	}
+	if len(columns) != len(rs.columns) {
+		return nil, fmt.Errorf("INSERT has %d columns, but SELECT returns %d", len(columns), len(rs.columns))
+	}
+
+	batch := max(1, maxInsertBinds/len(columns))
+	for start := 0; start < len(rs.rows); start += batch {
+		query, args := plan.valuesQuery(columns, rs.rows[start:min(start+batch, len(rs.rows))])
+		_, queries, _, err := s.resolve(plan.opts, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range queries {
+			for i := range q.rows {
+				q.rows[i] += start
+			}
+		}
+		stQueries = append(stQueries, queries...)
+	}
+	return
+}
+
+// valuesQuery returns the INSERT ... VALUES of rows, with the upsert clause and
+// returning columns of the original INSERT ... SELECT.
+func (plan *insertSelect) valuesQuery(columns []*sqlparser.Ident, rows [][]any) (query string, args []any) {
+	name := "?"
+	if plan.dollar {
+		name = "$"
+	}
+
+	// the binds of the upsert clause reference the original args
+	values := append([]any{}, plan.args...)
+	exprs := make([]*sqlparser.Exprs, 0, len(rows))
+	for _, row := range rows {
+		list := &sqlparser.Exprs{Exprs: make([]sqlparser.Expr, 0, len(row))}
+		for _, value := range row {
+			list.Exprs = append(list.Exprs, &sqlparser.BindExpr{Name: name, Pos: len(values)})
+			values = append(values, value)
+		}
+		exprs = append(exprs, list)
+	}
+
+	rw := &rewriter{}
+	defer rw.restore()
+	stmt := plan.stmt
+	replace(rw, &stmt.ColumnNames, columns)
+	replace(rw, &stmt.Expressions, exprs)
+	replace(rw, &stmt.Query, nil)
+	args = compactBinds(rw, stmt, values)
+
+	query = stmt.String()
+	if plan.upsert != nil {
+		query = plan.upsert.restore(query)
+		args = append(args, plan.upsert.updateArgs(plan.args)...)
+	}
+	return
+}
+
+// dollarBinds returns whether the bind parameters of node are like `$1`, by
+// the dialect of gorm DB when there are not any.
+func (s *Sharding) dollarBinds(node sqlparser.Node) (dollar bool) {
+	found := false
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		if b, ok := node.(*sqlparser.BindExpr); ok && !found {
+			dollar, found = strings.HasPrefix(b.Name, "$"), true
+		}
+		return nil
+	}), node)
+	if !found {
+		return s.DB != nil && s.DB.Dialector.Name() == "postgres"
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+)
+
+func TestInsertSelectQueries(t *testing.T) {
+	s := Register(Config{ShardingKey: "user_id", NumberOfShards: 4, PrimaryKeyGenerator: PKCustom, PrimaryKeyGeneratorFn: func(int64) int64 { return 0 }}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+	rs := &resultSet{columns: []string{"user_id", "product"}, rows: [][]any{{int64(101), "a"}, {[]byte("102"), "b"}, {int64(105), "c"}}}
+
+	_, stQueries, _, err := s.resolve(routeOptions{}, `INSERT INTO "orders" ("user_id", "product") SELECT "user_id", "product" FROM "staging" WHERE "batch" = $1 ON CONFLICT ("id") DO UPDATE SET "product" = $2 RETURNING "id"`, 7, "x")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 1, len(stQueries))
+	assert.Equal(t, `SELECT "user_id", "product" FROM "staging" WHERE "batch" = $1`, stQueries[0].query)
+	assert.Equal(t, []any{7}, stQueries[0].args)
+
+	plan := stQueries[0].insert
+	inserts, err := s.insertQueries(plan, rs)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 2, len(inserts))
+	assert.Equal(t, `INSERT INTO orders_1 ("user_id", "product") VALUES ($1, $2), ($3, $4) ON CONFLICT ("id") DO UPDATE SET "product" = $5 RETURNING "id"`, inserts[0].query)
+	assert.Equal(t, []any{int64(101), "a", int64(105), "c", "x"}, inserts[0].args)
+	assert.Equal(t, []int{0, 2}, inserts[0].rows)
+	assert.Equal(t, `INSERT INTO orders_2 ("user_id", "product") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "product" = $3 RETURNING "id"`, inserts[1].query)
+
+	// the columns of the SELECT are inserted when not specified
+	_, stQueries, _, err = s.resolve(routeOptions{}, "INSERT INTO orders SELECT * FROM staging ON DUPLICATE KEY UPDATE product = ?", "x")
+	assert.Equal[error](t, nil, err)
+	inserts, err = s.insertQueries(stQueries[0].insert, rs)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "INSERT INTO orders_1 (user_id, product) VALUES (?, ?), (?, ?) ON DUPLICATE KEY UPDATE product = ?", inserts[0].query)
+	assert.Equal(t, []any{int64(101), "a", int64(105), "c", "x"}, inserts[0].args)
+
+	// from sharding tables to a plain table
+	_, stQueries, _, err = s.resolve(routeOptions{}, "INSERT INTO archive SELECT * FROM orders WHERE user_id = ?", 101)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "SELECT * FROM orders_1 WHERE user_id = ?", stQueries[0].query)
+	inserts, err = s.insertQueries(stQueries[0].insert, rs)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "INSERT INTO archive (user_id, product) VALUES (?, ?), (?, ?), (?, ?)", inserts[0].query)
+
+	// neither table is sharded
+	_, stQueries, _, err = s.resolve(routeOptions{}, "INSERT INTO archive SELECT * FROM staging")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "INSERT INTO archive SELECT * FROM staging", stQueries[0].query)
+	assert.Equal(t, (*insertSelect)(nil), stQueries[0].insert)
+
+	_, err = s.insertQueries(plan, &resultSet{columns: []string{"user_id"}})
+	assert.NotEqual[error](t, nil, err)
+}
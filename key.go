@@ -0,0 +1,282 @@
+package sharding
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/longbridgeapp/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// CompositeKey is the value of a composite sharding key passed to ShardingAlgorithm,
+// one value for each column of Config.ShardingKeys in order.
+//
+//	func(value any) (suffix string, err error) {
+//		key := value.(sharding.CompositeKey)
+//		tenantID, region := key[0], key[1]
+//		...
+//	}
+type CompositeKey []any
+
+// NullKeyPolicy is how to route a NULL sharding key.
+type NullKeyPolicy int
+
+const (
+	// NullKeyError returns ErrNullShardingKey for a NULL sharding key.
+	NullKeyError NullKeyPolicy = iota
+	// NullKeyToSuffix routes a NULL sharding key to the table of Config.NullKeySuffix.
+	NullKeyToSuffix
+	// NullKeyToAlgorithm passes a NULL sharding key to ShardingAlgorithm as nil.
+	NullKeyToAlgorithm
+)
+
+// normalizeKey returns the canonical value of a sharding key, so the same value
+// of different Go types maps to the same table. Integers, and numeric strings or
+// bytes of integers, are int64 if they fit in, other numbers are decimal strings
+// without trailing zeros. driver.Valuer like sql.NullInt64 or decimals are
+// normalized by their values, and NULL is nil.
+func normalizeKey(value any) (any, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case CompositeKey:
+		key := make(CompositeKey, len(v))
+		for i, value := range v {
+			normalized, err := normalizeKey(value)
+			if err != nil {
+				return nil, err
+			}
+			key[i] = normalized
+		}
+		return key, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint:
+		return normalizeUint(uint64(v)), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return normalizeUint(v), nil
+	case float32:
+		return normalizeNumber(strconv.FormatFloat(float64(v), 'f', -1, 32)), nil
+	case float64:
+		return normalizeNumber(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case string:
+		return normalizeNumber(v), nil
+	case []byte:
+		return normalizeNumber(string(v)), nil
+	case bool, time.Time:
+		return v, nil
+	case driver.Valuer:
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && rv.IsNil() {
+			return nil, nil
+		}
+		value, err := v.Value()
+		if err != nil {
+			return nil, err
+		}
+		return normalizeKey(value)
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return normalizeKey(rv.Elem().Interface())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return normalizeUint(rv.Uint()), nil
+	case reflect.String:
+		return normalizeNumber(rv.String()), nil
+	}
+	return nil, fmt.Errorf("unsupported sharding key type %T", value)
+}
+
+func normalizeUint(v uint64) any {
+	if v > math.MaxInt64 {
+		return strconv.FormatUint(v, 10)
+	}
+	return int64(v)
+}
+
+var decimalRegexp = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)$`)
+
+// normalizeNumber returns int64 or the canonical decimal string of a decimal
+// string, other strings are not changed.
+func normalizeNumber(s string) any {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if !decimalRegexp.MatchString(s) {
+		return s
+	}
+	r, _ := new(big.Rat).SetString(s)
+	if r.IsInt() {
+		if r.Num().IsInt64() {
+			return r.Num().Int64()
+		}
+		return r.Num().String()
+	}
+	// there are less than len(s) digits after the point
+	return strings.TrimRight(r.FloatString(len(s)), "0")
+}
+
+// isNullKey returns whether the normalized sharding key is NULL, a composite
+// key is NULL when any column is.
+func isNullKey(value any) bool {
+	if key, ok := value.(CompositeKey); ok {
+		return slices.Contains(key, nil)
+	}
+	return value == nil
+}
+
+// compileKey wraps ShardingAlgorithm to pass it the normalized sharding key,
+// and to route NULL sharding keys by NullKeyPolicy. The keys of TimeSharding
+// are passed as they are, a string like "20261016" is a date rather than a
+// number. The keys of types not supported by normalizeKey are passed as they
+// are too, for the algorithms supporting them.
+func (c *Config) compileKey(normalize bool) error {
+	switch c.NullKeyPolicy {
+	case NullKeyError, NullKeyToAlgorithm:
+	case NullKeyToSuffix:
+		if !slices.Contains(c.ShardingSuffixs(), c.NullKeySuffix) {
+			return fmt.Errorf("NullKeySuffix %q should be in ShardingSuffixs", c.NullKeySuffix)
+		}
+	default:
+		return errors.New("NullKeyPolicy can only be one of NullKeyError, NullKeyToSuffix and NullKeyToAlgorithm")
+	}
+
+	algorithm := c.ShardingAlgorithm
+	policy, suffix := c.NullKeyPolicy, c.NullKeySuffix
+	c.ShardingAlgorithm = func(value any) (string, error) {
+		key, err := normalizeKey(value)
+		if err != nil {
+			return algorithm(value)
+		}
+		if isNullKey(key) {
+			switch policy {
+			case NullKeyToSuffix:
+				return suffix, nil
+			case NullKeyToAlgorithm:
+				return algorithm(key)
+			}
+			return "", ErrNullShardingKey
+		}
+		if !normalize {
+			return algorithm(value)
+		}
+		return algorithm(key)
+	}
+	return nil
+}
+
+// shardingKeys returns the columns of the sharding key.
+func (c Config) shardingKeys() []string {
+	if len(c.ShardingKeys) > 0 {
+		return c.ShardingKeys
+	}
+	return []string{c.ShardingKey}
+}
+
+// compositeSet routes by the `=` and `IN` conditions on the columns of a composite
+// sharding key, which are combined by AND at the top level of the condition.
+// It returns nil when any column is not restricted.
+func (cr *conditionRouter) compositeSet(condition sqlparser.Expr) (*shardSet, error) {
+	values := make(map[string][]any)
+	for _, expr := range conjuncts(condition) {
+		n, ok := expr.(*sqlparser.BinaryExpr)
+		if !ok || n.Op != sqlparser.EQ && n.Op != sqlparser.IN {
+			continue
+		}
+		name, ok := cr.columnName(n.X)
+		y := n.Y
+		if !ok && n.Op == sqlparser.EQ {
+			name, ok = cr.columnName(n.Y)
+			y = n.X
+		}
+		if !ok || !slices.Contains(cr.r.ShardingKeys, name) {
+			continue
+		}
+		if _, ok := values[name]; ok {
+			continue
+		}
+		switch y.(type) {
+		case *sqlparser.Ident, *sqlparser.QualifiedRef:
+			continue
+		}
+		if hasSubquery(y) {
+			continue
+		}
+
+		vs, err := conditionValues(n.Op, y, cr.args, keyValue)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = vs
+	}
+
+	keys := []CompositeKey{{}}
+	for _, column := range cr.r.ShardingKeys {
+		vs, ok := values[column]
+		if !ok {
+			return nil, nil
+		}
+		product := make([]CompositeKey, 0, len(keys)*len(vs))
+		for _, key := range keys {
+			for _, v := range vs {
+				product = append(product, append(slices.Clone(key), v))
+			}
+		}
+		keys = product
+	}
+
+	set := &shardSet{byKey: true}
+	for _, key := range keys {
+		suffix, err := cr.r.ShardingAlgorithm(key)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(set.suffixes, suffix) {
+			set.suffixes = append(set.suffixes, suffix)
+		}
+	}
+	return set, nil
+}
+
+// conjuncts returns the conditions combined by AND.
+func conjuncts(expr sqlparser.Expr) []sqlparser.Expr {
+	switch n := expr.(type) {
+	case *sqlparser.ParenExpr:
+		return conjuncts(n.X)
+	case *sqlparser.BinaryExpr:
+		if n.Op == sqlparser.AND {
+			return append(conjuncts(n.X), conjuncts(n.Y)...)
+		}
+	case nil:
+		return nil
+	}
+	return []sqlparser.Expr{expr}
+}
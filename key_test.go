@@ -0,0 +1,118 @@
+package sharding
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	five := int64(5)
+	var nilPointer *int64
+	for _, value := range []any{5, int32(5), uint64(5), "5", "+5", []byte("5"), 5.0, sql.NullInt64{Int64: 5, Valid: true}, &five} {
+		key, err := normalizeKey(value)
+		assert.Equal[error](t, nil, err)
+		assert.Equal[any](t, int64(5), key)
+	}
+	for _, value := range []any{12.5, "12.50", float32(12.5), sql.NullString{String: "12.5", Valid: true}} {
+		key, _ := normalizeKey(value)
+		assert.Equal[any](t, "12.5", key)
+	}
+	for _, value := range []any{nil, nilPointer, sql.NullInt64{}} {
+		key, _ := normalizeKey(value)
+		assert.Equal[any](t, nil, key)
+	}
+
+	key, _ := normalizeKey(uint64(1 << 63))
+	assert.Equal[any](t, "9223372036854775808", key)
+	key, _ = normalizeKey("0x10")
+	assert.Equal[any](t, "0x10", key)
+	key, _ = normalizeKey(CompositeKey{int32(1), []byte("US")})
+	assert.Equal[any](t, CompositeKey{int64(1), "US"}, key)
+	_, err := normalizeKey(struct{}{})
+	assert.NotEqual[error](t, nil, err)
+}
+
+func TestDefaultAlgorithmKeys(t *testing.T) {
+	s := Register(Config{ShardingKey: "user_id", NumberOfShards: 4, PrimaryKeyGenerator: PKSnowflake}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+	algorithm := s.configs["orders"].ShardingAlgorithm
+
+	expected, _ := algorithm(int64(101))
+	for _, value := range []any{101, uint32(101), "101", []byte("101"), sql.NullInt64{Int64: 101, Valid: true}} {
+		suffix, err := algorithm(value)
+		assert.Equal[error](t, nil, err)
+		assert.Equal(t, expected, suffix)
+	}
+
+	suffix, _ := algorithm(-1)
+	assert.Equal(t, "_3", suffix)
+	suffix, _ = algorithm("-5")
+	assert.Equal(t, "_3", suffix)
+
+	_, err := algorithm(nil)
+	assert.Equal(t, ErrNullShardingKey, err)
+	_, err = algorithm(sql.NullInt64{})
+	assert.Equal(t, ErrNullShardingKey, err)
+}
+
+func TestCustomAlgorithmKeys(t *testing.T) {
+	var keys []any
+	config := Config{
+		ShardingKey: "user_id",
+		ShardingAlgorithm: func(value any) (string, error) {
+			keys = append(keys, value)
+			return "_0", nil
+		},
+		PrimaryKeyGenerator:   PKCustom,
+		PrimaryKeyGeneratorFn: func(int64) int64 { return 0 },
+	}
+	s := Register(config, "orders")
+	assert.Equal[error](t, nil, s.compile())
+
+	// the same value of different types is passed to ShardingAlgorithm as one
+	for _, value := range []any{101, int32(101), "101", []byte("101")} {
+		_, _, _, err := s.resolve(routeOptions{}, `SELECT * FROM "orders" WHERE "user_id" = $1`, value)
+		assert.Equal[error](t, nil, err)
+	}
+	_, _, _, err := s.resolve(routeOptions{}, `SELECT * FROM "orders" WHERE "user_id" = '101'`)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, []any{int64(101), int64(101), int64(101), int64(101), int64(101)}, keys)
+}
+
+func TestNullKeyPolicy(t *testing.T) {
+	config := Config{
+		ShardingKey:           "user_id",
+		NumberOfShards:        4,
+		NullKeyPolicy:         NullKeyToSuffix,
+		NullKeySuffix:         "_0",
+		PrimaryKeyGenerator:   PKCustom,
+		PrimaryKeyGeneratorFn: func(int64) int64 { return 0 },
+	}
+	s := Register(config, "orders")
+	assert.Equal[error](t, nil, s.compile())
+
+	_, stQueries, _, err := s.resolve(routeOptions{}, `INSERT INTO "orders" ("user_id", "product") VALUES ($1, $2)`, nil, "iPad")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, `INSERT INTO orders_0 ("user_id", "product") VALUES ($1, $2)`, stQueries[0].query)
+
+	_, stQueries, _, err = s.resolve(routeOptions{}, `SELECT * FROM "orders" WHERE "user_id" IS NULL`)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, `SELECT * FROM orders_0 WHERE "user_id" IS NULL`, stQueries[0].query)
+
+	_, stQueries, _, err = s.resolve(routeOptions{}, `SELECT * FROM "orders" WHERE "user_id" = -5`)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, `SELECT * FROM orders_3 WHERE "user_id" = -5`, stQueries[0].query)
+
+	config.NullKeySuffix = "_9"
+	err = Register(config, "orders").compile()
+	assert.NotEqual[error](t, nil, err)
+
+	config.NullKeyPolicy = NullKeyError
+	s = Register(config, "orders")
+	assert.Equal[error](t, nil, s.compile())
+	_, _, _, err = s.resolve(routeOptions{}, `INSERT INTO "orders" ("user_id", "product") VALUES (NULL, $1)`, "iPad")
+	assert.Equal(t, true, errors.Is(err, ErrNullShardingKey))
+}
@@ -0,0 +1,257 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+	"golang.org/x/exp/slices"
+	"gorm.io/gorm"
+)
+
+// errMoveReturning occurs when an UPDATE which moves rows returns rows, like
+// `UPDATE ... RETURNING`, the rows moved can't be returned.
+var errMoveReturning = fmt.Errorf("%w: rows can not be moved by UPDATE returning rows", ErrUpdateShardingKey)
+
+// keyUpdate returns whether the UPDATE moves rows out of the sharding tables of
+// suffixes by setting the sharding key. It returns ErrUpdateShardingKey instead
+// when MoveOnKeyUpdate is not enabled.
+func keyUpdate(r Config, stmt *sqlparser.UpdateStatement, qualifiers, suffixes []string, args []any) (bool, error) {
+	if stmt.Alias != nil {
+		qualifiers = append(qualifiers, stmt.Alias.Name)
+	}
+	keys := r.shardingKeys()
+	values := make(map[string]any, len(keys))
+	assigned, known := false, true
+	for _, a := range stmt.Assignments {
+		for _, column := range a.Columns {
+			if !slices.Contains(keys, column.Name) || sameColumn(a.Expr, column.Name, qualifiers) {
+				continue
+			}
+			assigned = true
+			value, err := keyValue(a.Expr, args)
+			if err != nil || len(a.Columns) > 1 {
+				known = false
+				continue
+			}
+			values[column.Name] = value
+		}
+	}
+	if !assigned {
+		return false, nil
+	}
+
+	// the rows stay in the sharding table of the new key
+	if known && len(values) == len(keys) && len(suffixes) == 1 {
+		var key any = values[keys[0]]
+		if len(keys) > 1 {
+			composite := make(CompositeKey, 0, len(keys))
+			for _, k := range keys {
+				composite = append(composite, values[k])
+			}
+			key = composite
+		}
+		suffix, err := r.ShardingAlgorithm(key)
+		if err != nil {
+			return false, err
+		}
+		if suffix == suffixes[0] {
+			return false, nil
+		}
+	}
+
+	if !r.MoveOnKeyUpdate || len(stmt.FromList) > 0 {
+		return false, ErrUpdateShardingKey
+	}
+	return true, nil
+}
+
+// sameColumn returns whether expr is column itself, like `user_id = user_id`.
+func sameColumn(expr sqlparser.Expr, column string, qualifiers []string) bool {
+	switch expr := expr.(type) {
+	case *sqlparser.Ident:
+		return expr.Name == column
+	case *sqlparser.QualifiedRef:
+		return expr.Table != nil && slices.Contains(qualifiers, expr.Table.Name) &&
+			expr.Column != nil && expr.Column.Name == column
+	}
+	return false
+}
+
+// keyMove is the plan to move the rows updated by an UPDATE of the sharding
+// key on one sharding table. The primary keys of the rows are selected and
+// locked before the UPDATE, which updates only the rows of them. Then the rows
+// in the sharding table of another key are deleted, and inserted into that table.
+type keyMove struct {
+	// from, the sharding table updated, with its alias.
+	from string
+	// table, the sharding table updated.
+	table string
+	// key, the primary key column of the table.
+	key string
+	// where, the condition of the UPDATE and its args.
+	where     string
+	whereArgs []any
+	// update, the UPDATE without its condition and its args.
+	update     string
+	updateArgs []any
+	// insert, the plan to insert the rows into the sharding tables of their key.
+	insert *insertSelect
+}
+
+func (s *Sharding) newKeyMove(rw *rewriter, stmt *sqlparser.UpdateStatement, tableName string, args []any) *keyMove {
+	m := &keyMove{from: stmt.TableName.String(), table: stmt.TableName.Name.String(), key: s.configs[tableName].primaryKey}
+	if stmt.Alias != nil {
+		m.from += " AS " + stmt.Alias.String()
+	}
+	if condition := stmt.Condition; condition != nil {
+		replace(rw, &stmt.Condition, nil)
+		m.whereArgs = compactBinds(rw, condition, args)
+		m.where = " WHERE " + condition.String()
+	}
+	m.updateArgs = compactBinds(rw, stmt, args)
+	m.update = stmt.String()
+	insert := &sqlparser.InsertStatement{TableName: &sqlparser.TableName{Name: &sqlparser.Ident{Name: tableName}}}
+	m.insert = &insertSelect{stmt: insert, dollar: s.dollarBinds(stmt)}
+	return m
+}
+
+// byIDs returns query restricted to the rows of ids, and its args, the ids are
+// bound after args.
+func (m *keyMove) byIDs(query string, args, ids []any) (string, []any) {
+	binds := make([]string, len(ids))
+	for i := range ids {
+		binds[i] = "?"
+		if m.insert.dollar {
+			binds[i] = "$" + strconv.Itoa(len(args)+i+1)
+		}
+	}
+	return query + " WHERE " + m.key + " IN (" + strings.Join(binds, ", ") + ")", append(slices.Clip(args), ids...)
+}
+
+// moveRows executes the UPDATE queries of the sharding key, and moves the rows
+// updated to the sharding tables of their new key, all in one transaction. The
+// rows can be moved across data sources only in a transaction of two-phase
+// commit, which is begun when two-phase commit is enabled.
+func (pool ConnPool) moveRows(ctx context.Context, stQueries []shardQuery) (result sql.Result, err error) {
+	if _, inTx := pool.ConnPool.(gorm.TxCommitter); inTx {
+		return pool.moveAll(ctx, stQueries, pool.conn)
+	}
+
+	if pool.sharding.distributed() {
+		tx, err := pool.sharding.beginDistributedTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		txPool := ConnPool{ConnPool: tx, sharding: pool.sharding, options: pool.options}
+		if result, err = txPool.moveAll(ctx, stQueries, txPool.conn); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		return result, tx.Commit()
+	}
+
+	source := stQueries[0].source
+	conn, err := pool.conn(source)
+	if err != nil {
+		return nil, err
+	}
+	err = inTx(ctx, conn, func(tx gorm.ConnPool) (err error) {
+		result, err = pool.moveAll(ctx, stQueries, func(s string) (gorm.ConnPool, error) {
+			if s != source {
+				return nil, fmt.Errorf("%w: rows can be moved across data sources only by two-phase commit", ErrCrossDataSource)
+			}
+			return tx, nil
+		})
+		return
+	})
+	return result, err
+}
+
+// moveAll executes the moves of the queries on the connections of conn.
+func (pool ConnPool) moveAll(ctx context.Context, stQueries []shardQuery, conn func(source string) (gorm.ConnPool, error)) (sql.Result, error) {
+	results := make(shardResults, len(stQueries))
+	for i, q := range stQueries {
+		var err error
+		if results[i], err = pool.move(ctx, conn, q); err != nil {
+			return nil, err
+		}
+	}
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	return results, nil
+}
+
+func (pool ConnPool) move(ctx context.Context, conn func(source string) (gorm.ConnPool, error), q shardQuery) (sql.Result, error) {
+	m := q.move
+	from, err := conn(q.source)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := from.QueryContext(ctx, "SELECT "+m.key+" FROM "+m.from+m.where+" FOR UPDATE", m.whereArgs...)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := readResultSet(rows, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]any, 0, len(rs.rows))
+	for _, row := range rs.rows {
+		ids = append(ids, row[0])
+	}
+
+	if len(ids) == 0 {
+		return driver.RowsAffected(0), nil
+	}
+
+	update, updateArgs := m.byIDs(m.update, m.updateArgs, ids)
+	result, err := from.ExecContext(ctx, update, updateArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args := m.byIDs("SELECT * FROM "+m.table, nil, ids)
+	if rows, err = from.QueryContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+	if rs, err = readResultSet(rows, nil); err != nil {
+		return nil, err
+	}
+	idIndex := slices.Index(rs.columns, m.key)
+	if idIndex == -1 {
+		return nil, fmt.Errorf("can not move rows of %s without primary key column %s", m.table, m.key)
+	}
+
+	inserts, err := pool.sharding.insertQueries(m.insert, rs)
+	if err != nil {
+		return nil, err
+	}
+	for _, insert := range inserts {
+		if insert.suffix == q.suffix {
+			continue
+		}
+		to, err := conn(insert.source)
+		if err != nil {
+			return nil, err
+		}
+
+		moved := make([]any, 0, len(insert.rows))
+		for _, row := range insert.rows {
+			moved = append(moved, rs.rows[row][idIndex])
+		}
+		query, args := m.byIDs("DELETE FROM "+m.table, nil, moved)
+		if _, err = from.ExecContext(ctx, query, args...); err != nil {
+			return nil, err
+		}
+		if _, err = to.ExecContext(ctx, insert.query, insert.args...); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,51 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+)
+
+func TestKeyUpdate(t *testing.T) {
+	config := Config{ShardingKey: "user_id", NumberOfShards: 4, PrimaryKeyGenerator: PKCustom, PrimaryKeyGeneratorFn: func(int64) int64 { return 0 }}
+	s := Register(config, "orders")
+	assert.Equal[error](t, nil, s.compile())
+
+	for _, query := range []string{
+		`UPDATE "orders" SET "user_id" = $1 WHERE "user_id" = $2`,
+		`UPDATE "orders" SET "user_id" = "user_id" + $1 WHERE "user_id" = $2`,
+	} {
+		_, _, _, err := s.resolve(routeOptions{}, query, 5, 3)
+		assert.Equal(t, ErrUpdateShardingKey, err)
+	}
+
+	// the rows stay in the same sharding table
+	_, stQueries, _, err := s.resolve(routeOptions{}, `UPDATE "orders" SET "user_id" = $1 WHERE "user_id" = $2`, 7, 3)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, `UPDATE orders_3 SET "user_id" = $1 WHERE "user_id" = $2`, stQueries[0].query)
+	_, stQueries, _, err = s.resolve(routeOptions{}, "UPDATE orders AS o SET user_id = o.user_id, product = ? WHERE o.user_id = ?", "iPad", 3)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, (*keyMove)(nil), stQueries[0].move)
+
+	config.MoveOnKeyUpdate = true
+	s = Register(config, "orders")
+	assert.Equal[error](t, nil, s.compile())
+	_, stQueries, _, err = s.resolve(routeOptions{}, `UPDATE "orders" SET "user_id" = $1, "product" = $2 WHERE "user_id" = $3 AND "id" = $4`, 5, "iPad", 3, 42)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, `UPDATE orders_3 SET "user_id" = $1, "product" = $2 WHERE "user_id" = $3 AND "id" = $4`, stQueries[0].query)
+	move := stQueries[0].move
+	assert.Equal(t, "orders_3", move.table)
+	assert.Equal(t, ` WHERE "user_id" = $1 AND "id" = $2`, move.where)
+	assert.Equal(t, []any{3, 42}, move.whereArgs)
+	update, args := move.byIDs(move.update, move.updateArgs, []any{42, 43})
+	assert.Equal(t, `UPDATE orders_3 SET "user_id" = $1, "product" = $2 WHERE id IN ($3, $4)`, update)
+	assert.Equal(t, []any{5, "iPad", 42, 43}, args)
+	query, args := move.byIDs("DELETE FROM orders_3", nil, []any{42, 43})
+	assert.Equal(t, "DELETE FROM orders_3 WHERE id IN ($1, $2)", query)
+	assert.Equal(t, []any{42, 43}, args)
+
+	rs := &resultSet{columns: []string{"id", "user_id", "product"}, rows: [][]any{{int64(42), int64(5), "iPad"}}}
+	inserts, err := s.insertQueries(move.insert, rs)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "INSERT INTO orders_1 (id, user_id, product) VALUES ($1, $2, $3)", inserts[0].query)
+}
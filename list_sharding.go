@@ -0,0 +1,95 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ListSharding is the built-in algorithm to shard a table by lists of values
+// of the sharding key, like regions or countries. Lists maps the suffix of
+// every table to its values, and the values in no list are in the table of
+// Default, or can not be routed when it's empty.
+//
+//	sharding.Config{
+//		ShardingKey: "country",
+//		ListSharding: &sharding.ListSharding{
+//			Lists: map[string][]any{
+//				"_na": {"US", "CA"},
+//				"_eu": {"DE", "FR"},
+//			},
+//			Default: "_other",
+//		},
+//	}
+type ListSharding struct {
+	Lists   map[string][]any
+	Default string
+
+	// suffixs of Lists in order
+	suffixs []string
+}
+
+func (ls *ListSharding) compile() error {
+	if len(ls.Lists) == 0 {
+		return errors.New("ListSharding Lists is required")
+	}
+	ls.suffixs = make([]string, 0, len(ls.Lists))
+	for suffix := range ls.Lists {
+		ls.suffixs = append(ls.suffixs, suffix)
+	}
+	sort.Strings(ls.suffixs)
+
+	for _, suffix := range ls.suffixs {
+		for _, value := range ls.Lists[suffix] {
+			if found := ls.find(value); found != suffix {
+				return fmt.Errorf("ListSharding value %v is in both %s and %s", value, found, suffix)
+			}
+		}
+	}
+	return nil
+}
+
+// ShardingAlgorithm returns the suffix of the list has value.
+func (ls *ListSharding) ShardingAlgorithm(value any) (suffix string, err error) {
+	if value, err = normalizeKey(value); err != nil {
+		return "", err
+	}
+	if suffix = ls.find(value); suffix != "" {
+		return suffix, nil
+	}
+	if ls.Default != "" {
+		return ls.Default, nil
+	}
+	return "", fmt.Errorf("%v is not in the lists of ListSharding, and Default is not specified", value)
+}
+
+// ShardingSuffixs returns the suffixes of all lists and Default.
+func (ls *ListSharding) ShardingSuffixs() (suffixs []string) {
+	suffixs = append(suffixs, ls.suffixs...)
+	if _, ok := ls.Lists[ls.Default]; !ok && ls.Default != "" {
+		suffixs = append(suffixs, ls.Default)
+	}
+	return
+}
+
+// find returns the suffix of the first list has value.
+func (ls *ListSharding) find(value any) string {
+	for _, suffix := range ls.suffixs {
+		for _, v := range ls.Lists[suffix] {
+			if equalValues(value, v) {
+				return suffix
+			}
+		}
+	}
+	return ""
+}
+
+// equalValues reports whether two values of sharding key are equal, numbers
+// and numeric strings are compared by value.
+func equalValues(a, b any) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
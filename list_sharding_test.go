@@ -0,0 +1,55 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/longbridgeapp/assert"
+)
+
+func TestListSharding(t *testing.T) {
+	ls := &ListSharding{Lists: map[string][]any{
+		"_na": {"US", "CA"},
+		"_eu": {"DE", "FR"},
+	}}
+	assert.Equal[error](t, nil, ls.compile())
+	assert.Equal(t, []string{"_eu", "_na"}, ls.ShardingSuffixs())
+
+	suffix, err := ls.ShardingAlgorithm("CA")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "_na", suffix)
+	suffix, _ = ls.ShardingAlgorithm("FR")
+	assert.Equal(t, "_eu", suffix)
+	_, err = ls.ShardingAlgorithm("JP")
+	assert.NotEqual[error](t, nil, err)
+
+	ls.Default = "_other"
+	assert.Equal[error](t, nil, ls.compile())
+	assert.Equal(t, []string{"_eu", "_na", "_other"}, ls.ShardingSuffixs())
+	suffix, _ = ls.ShardingAlgorithm("JP")
+	assert.Equal(t, "_other", suffix)
+
+	// numbers are compared by value
+	ls = &ListSharding{Lists: map[string][]any{"_0": {1, 2}, "_1": {3}}}
+	assert.Equal[error](t, nil, ls.compile())
+	suffix, _ = ls.ShardingAlgorithm(int64(3))
+	assert.Equal(t, "_1", suffix)
+	suffix, _ = ls.ShardingAlgorithm("2")
+	assert.Equal(t, "_0", suffix)
+
+	ls = &ListSharding{Lists: map[string][]any{"_0": {1, 2}, "_1": {int64(2)}}}
+	assert.NotEqual[error](t, nil, ls.compile())
+}
+
+func TestListShardingPrimaryKey(t *testing.T) {
+	s := Register(Config{
+		ShardingKey:         "country",
+		ListSharding:        &ListSharding{Lists: map[string][]any{"_na": {"US", "CA"}, "_eu": {"DE", "FR"}}},
+		PrimaryKeyGenerator: PKSnowflake,
+	}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+
+	// the id generated for the second table is in it
+	node, _ := snowflake.NewNode(1)
+	assert.Equal(t, "_na", s.configs["orders"].ShardingAlgorithmByPrimaryKey(node.Generate().Int64()))
+}
@@ -0,0 +1,598 @@
+package sharding
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// hiddenColumnPrefix is the alias prefix of the columns added to the projection
+// for merging, they are removed before the rows reach gorm.
+const hiddenColumnPrefix = "_sharding_"
+
+// mergePlan merges the results of a SELECT executed on several sharding tables.
+type mergePlan struct {
+	orderBy []mergeOrder
+	// limit is -1 when there is no LIMIT.
+	limit  int64
+	offset int64
+	// hidden, the number of columns added to the end of the projection.
+	hidden int
+	// aggregates, how each column is combined, nil when there is no aggregate function.
+	aggregates []aggregate
+	// distinct, the merged rows are deduplicated for SELECT DISTINCT.
+	distinct bool
+	// maxDistinct, the max number of distinct rows or values kept in memory,
+	// it's checked by distinctLimit when the rows are read.
+	maxDistinct int
+
+	// grouped, the groups are across sharding tables and merged after the rows
+	// are returned, groupBy are the group columns.
+	grouped bool
+	groupBy []columnRef
+	// having, the HAVING condition evaluated after the groups are merged.
+	having     sqlparser.Expr
+	havingRefs map[sqlparser.Node]columnRef
+	args       []any
+}
+
+// columnRef refers to a result column by name, or by index when it's not -1.
+type columnRef struct {
+	column string
+	index  int
+}
+
+func (ref columnRef) resolve(columns []string) (int, error) {
+	index := ref.index
+	if index == -1 {
+		index = slices.Index(columns, ref.column)
+	}
+	if index < 0 || index >= len(columns) {
+		return -1, fmt.Errorf("%s is not in the result columns %v", ref.column, columns)
+	}
+	return index, nil
+}
+
+// mergeOrder is a sort key of ORDER BY.
+type mergeOrder struct {
+	columnRef
+	desc       bool
+	nullsFirst bool
+	// typ, the database type of the column.
+	typ string
+}
+
+// planMerge plans how to merge the results of stmt from several sharding tables,
+// and rewrites stmt for each of them: the sort keys not in the projection are
+// added as hidden columns, and `LIMIT n OFFSET m` is pushed down as `LIMIT n+m`.
+// The groups of GROUP BY without sharding key are merged after the rows are
+// returned, so LIMIT and HAVING with aggregate functions are not pushed down.
+// `COUNT(DISTINCT x)` is computed from the distinct values of x, which are
+// grouped by on the sharding tables.
+func (s *Sharding) planMerge(rw *rewriter, stmt *sqlparser.SelectStatement, r Config, args []any) (*mergePlan, []any, error) {
+	plan := &mergePlan{limit: -1, distinct: stmt.Distinct, maxDistinct: r.MaxDistinctValues}
+
+	// the groups by sharding key are in one sharding table, nothing to combine
+	groups := stmt.GroupingElements
+	grouped := len(groups) > 0
+	if !grouped || !groupsByKey(groups, r.shardingKeys()) {
+		if err := plan.planAggregates(rw, stmt, grouped); err != nil {
+			return nil, args, err
+		}
+	}
+
+	var compact bool
+	plan.grouped = plan.grouped || grouped && plan.aggregates != nil
+	if plan.grouped {
+		for _, expr := range groups {
+			ref, err := plan.resultColumn(rw, stmt, expr)
+			if err != nil {
+				return nil, args, err
+			}
+			plan.groupBy = append(plan.groupBy, ref)
+		}
+
+		// HAVING only on group columns can be evaluated on each sharding table
+		if stmt.HavingCondition != nil && hasAggregate(stmt.HavingCondition) {
+			plan.having, plan.args = stmt.HavingCondition, args
+			plan.havingRefs = make(map[sqlparser.Node]columnRef)
+			if err := plan.planHaving(rw, stmt, stmt.HavingCondition); err != nil {
+				return nil, args, err
+			}
+			compact = hasBind(stmt.HavingCondition)
+			replace[sqlparser.Expr](rw, &stmt.HavingCondition, nil)
+		}
+	}
+
+	for _, term := range stmt.OrderBy {
+		order := mergeOrder{desc: term.Desc}
+		switch {
+		case term.NullsFirst:
+			order.nullsFirst = true
+		case term.NullsLast:
+			order.nullsFirst = false
+		default:
+			// NULL is larger than any value in PostgreSQL, smaller in MySQL and SQLite
+			order.nullsFirst = term.Desc == s.nullsLargest()
+		}
+
+		ref, err := plan.resultColumn(rw, stmt, term.X)
+		if err != nil {
+			return nil, args, err
+		}
+		order.columnRef = ref
+		plan.orderBy = append(plan.orderBy, order)
+	}
+
+	if stmt.Limit != nil {
+		limit, ok := intValue(stmt.Limit, args)
+		if !ok {
+			return nil, args, fmt.Errorf("LIMIT %s is not supported for sharding tables", stmt.Limit.String())
+		}
+		var offset int64
+		if stmt.Offset != nil {
+			if offset, ok = intValue(stmt.Offset, args); !ok {
+				return nil, args, fmt.Errorf("OFFSET %s is not supported for sharding tables", stmt.Offset.String())
+			}
+		}
+		plan.limit, plan.offset = limit, offset
+
+		_, limitBind := stmt.Limit.(*sqlparser.BindExpr)
+		_, offsetBind := stmt.Offset.(*sqlparser.BindExpr)
+		compact = compact || limitBind || offsetBind
+		if plan.grouped {
+			// any sharding table may have rows of the groups in the window
+			replace[sqlparser.Expr](rw, &stmt.Limit, nil)
+		} else {
+			// every sharding table returns the first n+m rows
+			replace[sqlparser.Expr](rw, &stmt.Limit, &sqlparser.NumberLit{Value: strconv.FormatInt(limit+offset, 10)})
+		}
+		replace[sqlparser.Expr](rw, &stmt.Offset, nil)
+	}
+
+	if compact {
+		args = compactBinds(rw, stmt, args)
+	}
+	return plan, args, nil
+}
+
+func (s *Sharding) nullsLargest() bool {
+	return s.DB != nil && s.DB.Dialector.Name() == "postgres"
+}
+
+// resultColumn returns the result column of expr, it's added to the end of
+// the projection when not selected.
+func (plan *mergePlan) resultColumn(rw *rewriter, stmt *sqlparser.SelectStatement, expr sqlparser.Expr) (columnRef, error) {
+	if n, ok := expr.(*sqlparser.NumberLit); ok {
+		i, err := strconv.Atoi(n.Value)
+		if err != nil || i < 1 {
+			return columnRef{}, fmt.Errorf("invalid column position %s", n.Value)
+		}
+		return columnRef{index: i - 1}, nil
+	}
+	if name, ok := projectedName(stmt, expr); ok {
+		return columnRef{column: name, index: -1}, nil
+	}
+	return plan.addHidden(rw, stmt, expr)
+}
+
+// addHidden adds expr to the end of the projection, an aggregate function is
+// combined like in the projection.
+func (plan *mergePlan) addHidden(rw *rewriter, stmt *sqlparser.SelectStatement, expr sqlparser.Expr) (columnRef, error) {
+	plan.hidden++
+	ref := columnRef{column: hiddenColumnPrefix + strconv.Itoa(plan.hidden), index: -1}
+
+	var columns sqlparser.OutputNames
+	if stmt.Columns != nil {
+		columns = slices.Clone(*stmt.Columns)
+	} else {
+		replace(rw, &stmt.Columns, &sqlparser.OutputNames{})
+	}
+	column := &sqlparser.ResultColumn{Expr: expr, Alias: &sqlparser.Ident{Name: ref.column}}
+	columns = append(columns, column)
+	replace(rw, stmt.Columns, columns)
+
+	if plan.aggregates != nil {
+		plan.aggregates = append(plan.aggregates, aggregate{})
+		if err := plan.planAggregate(rw, stmt, len(columns)-1, column); err != nil {
+			return ref, err
+		}
+	}
+	return ref, nil
+}
+
+// projectedName returns the result column name of expr, when it's in the projection.
+func projectedName(stmt *sqlparser.SelectStatement, expr sqlparser.Expr) (string, bool) {
+	var star bool
+	var columns sqlparser.OutputNames
+	if stmt.Columns != nil {
+		columns = *stmt.Columns
+	}
+	for _, column := range columns {
+		if column.Star {
+			star = true
+			continue
+		}
+		if ref, ok := column.Expr.(*sqlparser.QualifiedRef); ok && ref.Star {
+			star = true
+			continue
+		}
+
+		if column.Alias != nil {
+			if ident, ok := expr.(*sqlparser.Ident); ok && ident.Name == column.Alias.Name {
+				return column.Alias.Name, true
+			}
+			if sameExpr(column.Expr, expr) {
+				return column.Alias.Name, true
+			}
+		} else if name, ok := refColumn(column.Expr); ok && sameExpr(column.Expr, expr) {
+			return name, true
+		}
+	}
+
+	// all columns are selected
+	if name, ok := refColumn(expr); ok && star {
+		return name, true
+	}
+	return "", false
+}
+
+// sameExpr returns whether two expressions are the same, the quotes of
+// identifiers are ignored.
+func sameExpr(x, y sqlparser.Expr) bool {
+	switch x := x.(type) {
+	case *sqlparser.Ident:
+		if y, ok := y.(*sqlparser.Ident); ok {
+			return x.Name == y.Name
+		}
+	case *sqlparser.QualifiedRef:
+		if y, ok := y.(*sqlparser.QualifiedRef); ok && !x.Star && !y.Star {
+			return sqlparser.IdentName(x.Table) == sqlparser.IdentName(y.Table) && sqlparser.IdentName(x.Column) == sqlparser.IdentName(y.Column)
+		}
+	}
+	return x.String() == y.String()
+}
+
+// refColumn returns the column name of `column` or `table.column`.
+func refColumn(expr sqlparser.Expr) (string, bool) {
+	switch expr := expr.(type) {
+	case *sqlparser.Ident:
+		return expr.Name, true
+	case *sqlparser.QualifiedRef:
+		if expr.Star || expr.Column == nil {
+			return "", false
+		}
+		return expr.Column.Name, true
+	}
+	return "", false
+}
+
+// intValue returns the integer value of a number literal or bind parameter.
+func intValue(expr sqlparser.Expr, args []any) (int64, bool) {
+	switch expr := expr.(type) {
+	case *sqlparser.NumberLit:
+		i, err := strconv.ParseInt(expr.Value, 10, 64)
+		return i, err == nil
+	case *sqlparser.BindExpr:
+		return toInt(args[expr.Pos])
+	}
+	return 0, false
+}
+
+// merge the result sets of all sharding tables, each of them is sorted by ORDER BY.
+func (plan *mergePlan) merge(sets []*resultSet) (*resultSet, error) {
+	rs := &resultSet{columns: sets[0].columns, types: sets[0].types}
+	for _, other := range sets[1:] {
+		if len(other.columns) != len(rs.columns) {
+			return nil, fmt.Errorf("sharding tables return different columns: %v and %v", rs.columns, other.columns)
+		}
+	}
+
+	if plan.grouped {
+		var rows [][]any
+		for _, set := range sets {
+			rows = append(rows, set.rows...)
+		}
+		rows, err := plan.regroup(rs.columns, rs.types, rows)
+		if err != nil {
+			return nil, err
+		}
+		orders, err := plan.resolveOrders(rs.columns, rs.types)
+		if err != nil {
+			return nil, err
+		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			return compareRows(rows[i], rows[j], orders) < 0
+		})
+		rs.rows = rows
+	} else if plan.aggregates != nil {
+		var rows [][]any
+		for _, set := range sets {
+			rows = append(rows, set.rows...)
+		}
+		row, err := plan.combine(rs.columns, rs.types, rows)
+		if err != nil {
+			return nil, err
+		}
+		rs.rows = [][]any{row}
+	} else if len(plan.orderBy) == 0 {
+		for _, set := range sets {
+			rs.rows = append(rs.rows, set.rows...)
+		}
+	} else {
+		orders, err := plan.resolveOrders(rs.columns, rs.types)
+		if err != nil {
+			return nil, err
+		}
+		rs.rows = mergeSorted(sets, orders)
+	}
+
+	n := len(rs.columns) - plan.hidden
+	if plan.distinct {
+		rows, err := plan.dedupe(rs.rows, n)
+		if err != nil {
+			return nil, err
+		}
+		rs.rows = rows
+	}
+
+	plan.window(rs)
+	if plan.hidden > 0 {
+		rs.columns, rs.types = rs.columns[:n], rs.types[:n]
+		for i, row := range rs.rows {
+			rs.rows[i] = row[:n]
+		}
+	}
+	return rs, nil
+}
+
+// dedupe removes the duplicate rows by the first n columns, the first row of
+// duplicates is kept.
+func (plan *mergePlan) dedupe(rows [][]any, n int) ([][]any, error) {
+	seen := make(map[string]bool)
+	result := rows[:0]
+	for _, row := range rows {
+		key := distinctKey(row[:n])
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+// distinctLimit counts the distinct rows or values while the rows of sharding
+// tables are read, so the rows are not all buffered before MaxDistinctValues
+// is exceeded. The rows of SELECT DISTINCT are distinct by the selected
+// columns, and the values of the distinct aggregates by the groups.
+type distinctLimit struct {
+	plan    *mergePlan
+	refs    []columnRef
+	indexes []int
+	seen    map[string]bool
+}
+
+// distinctLimit returns the limit of the rows read for plan, nil when nothing
+// distinct is merged.
+func (plan *mergePlan) distinctLimit() *distinctLimit {
+	limit := &distinctLimit{plan: plan, seen: make(map[string]bool)}
+	for _, agg := range plan.aggregates {
+		if agg.distinct {
+			limit.refs = append(limit.refs, agg.values)
+		}
+	}
+	if len(limit.refs) > 0 {
+		limit.refs = append(slices.Clone(plan.groupBy), limit.refs...)
+	} else if !plan.distinct {
+		return nil
+	}
+	return limit
+}
+
+// add counts a row read, ErrDistinctLimitExceeded is returned when there are
+// more than MaxDistinctValues distinct rows or values.
+func (limit *distinctLimit) add(columns []string, row []any) error {
+	if limit == nil {
+		return nil
+	}
+	if limit.indexes == nil {
+		if len(limit.refs) == 0 {
+			for i := 0; i < len(columns)-limit.plan.hidden; i++ {
+				limit.indexes = append(limit.indexes, i)
+			}
+		}
+		for _, ref := range limit.refs {
+			index, err := ref.resolve(columns)
+			if err != nil {
+				return fmt.Errorf("DISTINCT: %w", err)
+			}
+			limit.indexes = append(limit.indexes, index)
+		}
+	}
+
+	values := make([]any, 0, len(limit.indexes))
+	for _, index := range limit.indexes {
+		values = append(values, row[index])
+	}
+	key := distinctKey(values)
+	if limit.seen[key] {
+		return nil
+	}
+	if len(limit.seen) >= limit.plan.maxDistinct {
+		return fmt.Errorf("%w: more than %d", ErrDistinctLimitExceeded, limit.plan.maxDistinct)
+	}
+	limit.seen[key] = true
+	return nil
+}
+
+// resolveOrders returns the sort keys with the index and type of result columns.
+func (plan *mergePlan) resolveOrders(columns, types []string) ([]mergeOrder, error) {
+	orders := slices.Clone(plan.orderBy)
+	for i, order := range orders {
+		index, err := order.resolve(columns)
+		if err != nil {
+			return nil, fmt.Errorf("ORDER BY: %w", err)
+		}
+		orders[i].index, orders[i].typ = index, types[index]
+	}
+	return orders, nil
+}
+
+// window applies OFFSET and LIMIT.
+func (plan *mergePlan) window(rs *resultSet) {
+	if plan.offset > 0 {
+		if plan.offset >= int64(len(rs.rows)) {
+			rs.rows = nil
+		} else {
+			rs.rows = rs.rows[plan.offset:]
+		}
+	}
+	if plan.limit >= 0 && plan.limit < int64(len(rs.rows)) {
+		rs.rows = rs.rows[:plan.limit]
+	}
+}
+
+// mergeSorted is a k-way merge of the sorted rows.
+func mergeSorted(sets []*resultSet, orders []mergeOrder) [][]any {
+	h := &rowHeap{orders: orders}
+	var total int
+	for _, set := range sets {
+		if len(set.rows) > 0 {
+			h.cursors = append(h.cursors, &rowCursor{rows: set.rows})
+			total += len(set.rows)
+		}
+	}
+	heap.Init(h)
+
+	rows := make([][]any, 0, total)
+	for h.Len() > 0 {
+		c := h.cursors[0]
+		rows = append(rows, c.rows[c.pos])
+		c.pos++
+		if c.pos == len(c.rows) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return rows
+}
+
+type rowCursor struct {
+	rows [][]any
+	pos  int
+}
+
+type rowHeap struct {
+	cursors []*rowCursor
+	orders  []mergeOrder
+}
+
+func (h *rowHeap) Len() int {
+	return len(h.cursors)
+}
+
+func (h *rowHeap) Less(i, j int) bool {
+	a, b := h.cursors[i], h.cursors[j]
+	return compareRows(a.rows[a.pos], b.rows[b.pos], h.orders) < 0
+}
+
+func (h *rowHeap) Swap(i, j int) {
+	h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i]
+}
+
+func (h *rowHeap) Push(x any) {
+	h.cursors = append(h.cursors, x.(*rowCursor))
+}
+
+func (h *rowHeap) Pop() any {
+	c := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return c
+}
+
+func compareRows(a, b []any, orders []mergeOrder) int {
+	for _, order := range orders {
+		x, y := a[order.index], b[order.index]
+		var c int
+		switch {
+		case x == nil && y == nil:
+			continue
+		case x == nil:
+			c = 1
+			if order.nullsFirst {
+				c = -1
+			}
+			return c
+		case y == nil:
+			c = -1
+			if order.nullsFirst {
+				c = 1
+			}
+			return c
+		}
+
+		c = compareResult(resultValue(x, order.typ), resultValue(y, order.typ))
+		if order.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// numericTypes are the database types of numeric columns, which are returned
+// as []byte by MySQL.
+var numericTypes = map[string]bool{
+	"TINYINT": true, "SMALLINT": true, "MEDIUMINT": true, "INT": true, "INTEGER": true, "BIGINT": true,
+	"INT2": true, "INT4": true, "INT8": true, "YEAR": true,
+	"DECIMAL": true, "NUMERIC": true, "FLOAT": true, "FLOAT4": true, "FLOAT8": true, "DOUBLE": true, "REAL": true,
+}
+
+// resultValue returns the value of a column of type typ scanned from the
+// results, the values of numeric columns are parsed to numbers, the others
+// are kept, so text is compared as text whatever it looks like.
+func resultValue(v any, typ string) any {
+	v = normalizeResult(v)
+	if s, ok := v.(string); ok && numericTypes[strings.TrimPrefix(strings.ToUpper(typ), "UNSIGNED ")] {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// compareResult compares two values returned by resultValue. Strings are
+// compared as strings, not by the numbers they look like.
+func compareResult(x, y any) int {
+	if x, ok := x.(string); ok {
+		if y, ok := y.(string); ok {
+			return cmp.Compare(x, y)
+		}
+	}
+	if c, ok := compareValues(x, y); ok {
+		return c
+	}
+
+	if x, ok := x.(bool); ok {
+		if y, ok := y.(bool); ok && x != y {
+			if x {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package sharding
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// planQuery plans the merge of query, and returns the query executed on each
+// sharding table.
+func planQuery(t *testing.T, query string) (*mergePlan, string) {
+	expr, err := sqlparser.NewParser(strings.NewReader(query)).ParseStatement()
+	assert.Equal[error](t, nil, err)
+	stmt := expr.(*sqlparser.SelectStatement)
+	plan, _, err := (&Sharding{}).planMerge(&rewriter{}, stmt, Config{ShardingKey: "user_id", MaxDistinctValues: 100}, nil)
+	assert.Equal[error](t, nil, err)
+	return plan, stmt.String()
+}
+
+func TestMergeAvg(t *testing.T) {
+	plan, query := planQuery(t, `SELECT AVG(amount), product FROM orders GROUP BY product`)
+	// AVG(amount) is not renamed, so it keeps the column name of the dialect
+	assert.Equal(t, `SELECT AVG(amount), product, SUM(amount) AS _sharding_1, COUNT(amount) AS _sharding_2 FROM orders GROUP BY product`, query)
+
+	columns := []string{"AVG(amount)", "product", "_sharding_1", "_sharding_2"}
+	rs, err := plan.merge([]*resultSet{
+		{columns: columns, types: make([]string, 4), rows: [][]any{{2.0, "iPad", int64(8), int64(4)}}},
+		{columns: columns, types: make([]string, 4), rows: [][]any{{1.0, "iPad", int64(4), int64(4)}}},
+	})
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, []string{"AVG(amount)", "product"}, rs.columns)
+	assert.Equal(t, [][]any{{1.5, "iPad"}}, rs.rows)
+}
+
+func TestMergeHaving(t *testing.T) {
+	plan, query := planQuery(t, `SELECT AVG(amount), product FROM orders GROUP BY product HAVING SUM(amount) > 10`)
+	// SUM(amount) of HAVING is not the SUM(amount) of AVG(amount)
+	assert.Equal(t, `SELECT AVG(amount), product, SUM(amount) AS _sharding_1, COUNT(amount) AS _sharding_2, SUM(amount) AS _sharding_3 FROM orders GROUP BY product`, query)
+
+	columns := []string{"AVG(amount)", "product", "_sharding_1", "_sharding_2", "_sharding_3"}
+	rs, err := plan.merge([]*resultSet{
+		{columns: columns, types: make([]string, 5), rows: [][]any{{2.0, "iPad", int64(8), int64(4), int64(8)}, {1.0, "iPhone", int64(2), int64(2), int64(2)}}},
+		{columns: columns, types: make([]string, 5), rows: [][]any{{2.0, "iPad", int64(4), int64(2), int64(4)}}},
+	})
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, [][]any{{2.0, "iPad"}}, rs.rows)
+}
+
+func TestMergeCountDistinct(t *testing.T) {
+	plan, query := planQuery(t, `SELECT COUNT(DISTINCT("user_id")) FROM orders`)
+	// COUNT(DISTINCT x) is not renamed, the values of x are in a hidden column
+	assert.Equal(t, `SELECT COUNT(DISTINCT ("user_id")), ("user_id") AS _sharding_1 FROM orders GROUP BY ("user_id")`, query)
+
+	columns := []string{"count", "_sharding_1"}
+	sets := []*resultSet{
+		{columns: columns, types: make([]string, 2), rows: [][]any{{int64(1), int64(100)}, {int64(1), int64(104)}}},
+		{columns: columns, types: make([]string, 2), rows: [][]any{{int64(1), int64(100)}, {int64(0), nil}}},
+	}
+	limit := plan.distinctLimit()
+	for _, set := range sets {
+		for _, row := range set.rows {
+			assert.Equal[error](t, nil, limit.add(columns, row))
+		}
+	}
+	rs, err := plan.merge(sets)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, [][]any{{int64(2)}}, rs.rows)
+
+	// the limit is exceeded while the rows are read
+	plan.maxDistinct = 2
+	limit = plan.distinctLimit()
+	assert.Equal[error](t, nil, limit.add(columns, []any{int64(1), int64(100)}))
+	assert.Equal[error](t, nil, limit.add(columns, []any{int64(1), int64(104)}))
+	assert.Equal[error](t, nil, limit.add(columns, []any{int64(1), int64(100)}))
+	assert.Equal(t, true, errors.Is(limit.add(columns, []any{int64(1), int64(105)}), ErrDistinctLimitExceeded))
+
+	plan, _ = planQuery(t, `SELECT AVG(amount) FROM orders`)
+	assert.Equal(t, (*distinctLimit)(nil), plan.distinctLimit())
+}
+
+func TestMergeOrderByType(t *testing.T) {
+	plan, _ := planQuery(t, `SELECT code FROM orders ORDER BY code`)
+	// text is sorted as text, like the collation of the database
+	rs, err := plan.merge([]*resultSet{
+		{columns: []string{"code"}, types: []string{"VARCHAR"}, rows: [][]any{{[]byte("9")}, {[]byte("a")}}},
+		{columns: []string{"code"}, types: []string{"VARCHAR"}, rows: [][]any{{[]byte("10")}}},
+	})
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, [][]any{{[]byte("10")}, {[]byte("9")}, {[]byte("a")}}, rs.rows)
+
+	// numbers returned as text by MySQL are sorted as numbers
+	rs, err = plan.merge([]*resultSet{
+		{columns: []string{"code"}, types: []string{"BIGINT"}, rows: [][]any{{[]byte("9")}}},
+		{columns: []string{"code"}, types: []string{"BIGINT"}, rows: [][]any{{[]byte("10")}}},
+	})
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, [][]any{{[]byte("9")}, {[]byte("10")}}, rs.rows)
+}
@@ -1,6 +1,13 @@
 package sharding
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
 
 const (
 	// Use Snowflake primary key generator
@@ -17,6 +24,37 @@ func (s *Sharding) genSnowflakeKey(index int64) int64 {
 	return s.snowflakeNodes[index].Generate().Int64()
 }
 
+// suffixIndex returns the index of the sharding table of suffix, which the
+// primary key is generated by, like the snowflake node.
+func (c Config) suffixIndex(suffix string) (int64, error) {
+	index := int64(-1)
+	if c.suffixs != nil {
+		index = int64(slices.Index(c.suffixs, suffix))
+	} else if i, err := strconv.Atoi(strings.Replace(suffix, "_", "", 1)); err == nil {
+		index = int64(i)
+	} else {
+		index = int64(slices.Index(c.ShardingSuffixs(), suffix))
+	}
+	if index == -1 {
+		return 0, errors.New("table suffix '" + suffix + "' is not in ShardingSuffixs. In order to generate the primary key, ShardingSuffixs should include all table suffixes")
+	}
+	if c.PrimaryKeyGenerator == PKSnowflake && index >= 1024 {
+		return 0, fmt.Errorf("table suffix '%s' is out of the 1024 Snowflake nodes", suffix)
+	}
+	return index, nil
+}
+
+// indexSuffix returns the suffix of the sharding table of index, "" if it's out of ShardingSuffixs.
+func (c Config) indexSuffix(index int64) string {
+	if c.suffixs == nil {
+		return fmt.Sprintf(c.tableFormat, index)
+	}
+	if index < int64(len(c.suffixs)) {
+		return c.suffixs[index]
+	}
+	return ""
+}
+
 // PostgreSQL sequence
 
 func (s *Sharding) genPostgreSQLSequenceKey(tableName string, index int64) int64 {
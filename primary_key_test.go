@@ -9,3 +9,19 @@ import (
 func Test_pgSeqName(t *testing.T) {
 	assert.Equal(t, "gorm_sharding_users_id_seq", pgSeqName("users"))
 }
+
+func TestInsertPrimaryKey(t *testing.T) {
+	s := Register(Config{ShardingKey: "user_id", NumberOfShards: 4, PrimaryKeyGenerator: PKCustom, PrimaryKeyGeneratorFn: func(int64) int64 { return 42 }}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+	c := s.configs["orders"]
+	c.primaryKey = "order_id"
+	s.configs["orders"] = c
+
+	_, stQueries, _, err := s.resolve(routeOptions{}, "INSERT INTO orders (user_id, product) VALUES (?, ?)", 101, "a")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "INSERT INTO orders_1 (user_id, product, order_id) VALUES (?, ?, 42)", stQueries[0].query)
+
+	_, stQueries, _, err = s.resolve(routeOptions{}, "INSERT INTO orders (order_id, user_id, product) VALUES (?, ?, ?)", 7, 101, "a")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "INSERT INTO orders_1 (order_id, user_id, product) VALUES (?, ?, ?)", stQueries[0].query)
+}
@@ -0,0 +1,134 @@
+package sharding
+
+import (
+	"cmp"
+	"strconv"
+	"time"
+)
+
+// Range is a range of sharding key values, generated from `BETWEEN`, `<`, `<=`,
+// `>` and `>=` conditions. A nil Min or Max means the range is unbounded on that side.
+type Range struct {
+	Min          any
+	MinInclusive bool
+	Max          any
+	MaxInclusive bool
+}
+
+// intersect returns the intersection of two ranges, ok is false when the
+// bounds can not be compared.
+func (r Range) intersect(other Range) (result Range, ok bool) {
+	result = r
+	if other.Min != nil {
+		if r.Min == nil {
+			result.Min, result.MinInclusive = other.Min, other.MinInclusive
+		} else {
+			c, ok := compareValues(other.Min, r.Min)
+			if !ok {
+				return r, false
+			}
+			if c > 0 || c == 0 && !other.MinInclusive {
+				result.Min, result.MinInclusive = other.Min, other.MinInclusive
+			}
+		}
+	}
+	if other.Max != nil {
+		if r.Max == nil {
+			result.Max, result.MaxInclusive = other.Max, other.MaxInclusive
+		} else {
+			c, ok := compareValues(other.Max, r.Max)
+			if !ok {
+				return r, false
+			}
+			if c < 0 || c == 0 && !other.MaxInclusive {
+				result.Max, result.MaxInclusive = other.Max, other.MaxInclusive
+			}
+		}
+	}
+	return result, true
+}
+
+// compareValues compare two values of sharding key, numbers and numeric
+// strings are compared by value. ok is false when they are not comparable.
+func compareValues(a, b any) (c int, ok bool) {
+	if x, ok := toInt(a); ok {
+		if y, ok := toInt(b); ok {
+			return cmp.Compare(x, y), true
+		}
+	}
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return cmp.Compare(x, y), true
+		}
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return cmp.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), true
+		}
+	}
+	return 0, false
+}
+
+func toInt(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/exp/slices"
+)
+
+// RangeSharding is the built-in algorithm to shard a table by ranges of the
+// sharding key, every range is in the table of its suffix. The ranges should
+// be in order, contiguous and not overlapped, and End of the last one can be
+// nil for an open-ended range.
+//
+//	sharding.Config{
+//		ShardingKey: "user_id",
+//		RangeSharding: &sharding.RangeSharding{Ranges: []sharding.KeyRange{
+//			{Start: 0, End: 1_000_000, Suffix: "_0"},
+//			{Start: 1_000_000, End: 5_000_000, Suffix: "_1"},
+//			{Start: 5_000_000, Suffix: "_2"},
+//		}},
+//	}
+type RangeSharding struct {
+	Ranges []KeyRange
+}
+
+// KeyRange is the range [Start, End) of the sharding key in the table of Suffix.
+type KeyRange struct {
+	Start  any
+	End    any
+	Suffix string
+}
+
+func (rs *RangeSharding) compile() error {
+	if len(rs.Ranges) == 0 {
+		return errors.New("RangeSharding Ranges is required")
+	}
+	for i, kr := range rs.Ranges {
+		if kr.Start == nil || kr.Suffix == "" {
+			return fmt.Errorf("RangeSharding range %d should have Start and Suffix", i)
+		}
+		if kr.End == nil {
+			if i != len(rs.Ranges)-1 {
+				return fmt.Errorf("RangeSharding range %d is open-ended, only the last range can be", i)
+			}
+			continue
+		}
+		if c, ok := compareValues(kr.Start, kr.End); !ok || c >= 0 {
+			return fmt.Errorf("RangeSharding range %d should have Start less than End", i)
+		}
+		if i+1 < len(rs.Ranges) {
+			if c, ok := compareValues(kr.End, rs.Ranges[i+1].Start); !ok || c != 0 {
+				return fmt.Errorf("RangeSharding range %d should start at End of range %d", i+1, i)
+			}
+		}
+	}
+	return nil
+}
+
+// ShardingAlgorithm returns the suffix of the range value is in.
+func (rs *RangeSharding) ShardingAlgorithm(value any) (suffix string, err error) {
+	if value, err = normalizeKey(value); err != nil {
+		return "", err
+	}
+	for _, kr := range rs.Ranges {
+		if c, ok := compareValues(value, kr.Start); !ok {
+			return "", fmt.Errorf("invalid value %v of RangeSharding", value)
+		} else if c < 0 {
+			break
+		}
+		if kr.End == nil {
+			return kr.Suffix, nil
+		}
+		if c, _ := compareValues(value, kr.End); c < 0 {
+			return kr.Suffix, nil
+		}
+	}
+	return "", fmt.Errorf("%v is out of the ranges of RangeSharding", value)
+}
+
+// ShardingSuffixs returns the suffixes of all ranges.
+func (rs *RangeSharding) ShardingSuffixs() (suffixs []string) {
+	for _, kr := range rs.Ranges {
+		if !slices.Contains(suffixs, kr.Suffix) {
+			suffixs = append(suffixs, kr.Suffix)
+		}
+	}
+	return
+}
+
+// ShardingAlgorithmByRange returns the suffixes of the ranges overlapped with r.
+func (rs *RangeSharding) ShardingAlgorithmByRange(r Range) (suffixs []string, err error) {
+	for _, kr := range rs.Ranges {
+		if r.Max != nil {
+			c, ok := compareValues(kr.Start, r.Max)
+			if !ok {
+				return nil, fmt.Errorf("invalid value %v of RangeSharding", r.Max)
+			}
+			if c > 0 || c == 0 && !r.MaxInclusive {
+				break
+			}
+		}
+		if r.Min != nil && kr.End != nil {
+			c, ok := compareValues(r.Min, kr.End)
+			if !ok {
+				return nil, fmt.Errorf("invalid value %v of RangeSharding", r.Min)
+			}
+			if c >= 0 {
+				continue
+			}
+		}
+		if !slices.Contains(suffixs, kr.Suffix) {
+			suffixs = append(suffixs, kr.Suffix)
+		}
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/longbridgeapp/assert"
+)
+
+func TestRangeSharding(t *testing.T) {
+	rs := &RangeSharding{Ranges: []KeyRange{
+		{Start: 0, End: 1_000_000, Suffix: "_0"},
+		{Start: 1_000_000, End: 5_000_000, Suffix: "_1"},
+		{Start: 5_000_000, Suffix: "_2"},
+	}}
+	assert.Equal[error](t, nil, rs.compile())
+	assert.Equal(t, []string{"_0", "_1", "_2"}, rs.ShardingSuffixs())
+
+	suffix, err := rs.ShardingAlgorithm(int64(999_999))
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "_0", suffix)
+	suffix, _ = rs.ShardingAlgorithm("1000000")
+	assert.Equal(t, "_1", suffix)
+	suffix, _ = rs.ShardingAlgorithm(int64(9_000_000_000))
+	assert.Equal(t, "_2", suffix)
+	_, err = rs.ShardingAlgorithm(-1)
+	assert.NotEqual[error](t, nil, err)
+
+	suffixs, err := rs.ShardingAlgorithmByRange(Range{Min: int64(500), MinInclusive: true, Max: int64(1_000_000)})
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, []string{"_0"}, suffixs)
+	suffixs, _ = rs.ShardingAlgorithmByRange(Range{Min: int64(500), Max: int64(1_000_000), MaxInclusive: true})
+	assert.Equal(t, []string{"_0", "_1"}, suffixs)
+	suffixs, _ = rs.ShardingAlgorithmByRange(Range{Min: int64(5_000_000), MinInclusive: true})
+	assert.Equal(t, []string{"_2"}, suffixs)
+
+	for _, ranges := range [][]KeyRange{
+		// gap
+		{{Start: 0, End: 100, Suffix: "_0"}, {Start: 200, Suffix: "_1"}},
+		// overlapped
+		{{Start: 0, End: 100, Suffix: "_0"}, {Start: 50, Suffix: "_1"}},
+		// open-ended in the middle
+		{{Start: 0, Suffix: "_0"}, {Start: 100, Suffix: "_1"}},
+		// empty
+		{{Start: 100, End: 100, Suffix: "_0"}},
+	} {
+		rs = &RangeSharding{Ranges: ranges}
+		assert.NotEqual[error](t, nil, rs.compile())
+	}
+}
+
+func TestRangeShardingPrimaryKey(t *testing.T) {
+	s := Register(Config{
+		ShardingKey: "user_id",
+		RangeSharding: &RangeSharding{Ranges: []KeyRange{
+			{Start: 0, End: 1_000_000, Suffix: "_small"},
+			{Start: 1_000_000, Suffix: "_big"},
+		}},
+		PrimaryKeyGenerator: PKSnowflake,
+	}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+
+	// the node is the position of the suffix in ShardingSuffixs
+	r := s.configs["orders"]
+	index, err := r.suffixIndex("_big")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(1), index)
+
+	node, _ := snowflake.NewNode(index)
+	assert.Equal(t, "_big", r.ShardingAlgorithmByPrimaryKey(node.Generate().Int64()))
+}
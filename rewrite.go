@@ -0,0 +1,102 @@
+package sharding
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+)
+
+// rewriter records the changes made to a parsed statement, so the statement
+// can be restored and rewritten again for another sharding table.
+type rewriter struct {
+	undo []func()
+}
+
+// replace set *p to v, the old value will be put back by restore.
+func replace[T any](rw *rewriter, p *T, v T) {
+	old := *p
+	*p = v
+	rw.undo = append(rw.undo, func() { *p = old })
+}
+
+// restore undo all changes in reverse order.
+func (rw *rewriter) restore() {
+	for i := len(rw.undo) - 1; i >= 0; i-- {
+		rw.undo[i]()
+	}
+	rw.undo = rw.undo[:0]
+}
+
+// compactBinds renumber the bind parameters of node in order of appearance,
+// and return the args they reference. Used after some binds are removed.
+func compactBinds(rw *rewriter, node sqlparser.Node, args []any) (newArgs []any) {
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		if b, ok := node.(*sqlparser.BindExpr); ok {
+			newArgs = append(newArgs, args[b.Pos])
+			replace(rw, &b.Pos, len(newArgs)-1)
+			if strings.HasPrefix(b.Name, "$") {
+				replace(rw, &b.Name, "$"+strconv.Itoa(len(newArgs)))
+			}
+		}
+		return nil
+	}), node)
+
+	return newArgs
+}
+
+// falseExpr rewrite a binary expression to `1 = 0`.
+func falseExpr(rw *rewriter, n *sqlparser.BinaryExpr) {
+	replace[sqlparser.Expr](rw, &n.X, &sqlparser.NumberLit{Value: "1"})
+	replace(rw, &n.Op, sqlparser.EQ)
+	replace[sqlparser.Expr](rw, &n.Y, &sqlparser.NumberLit{Value: "0"})
+}
+
+// renameTables rename the tables in node by names, and the columns qualified
+// by the table name of them.
+func renameTables(rw *rewriter, node sqlparser.Node, names map[string]string) {
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		switch n := node.(type) {
+		case *sqlparser.TableName:
+			if n.Name == nil {
+				return nil
+			}
+			if name, ok := names[n.Name.Name]; ok {
+				replace(rw, &n.Name, &sqlparser.Ident{Name: name})
+			}
+		case *sqlparser.QualifiedRef:
+			if n.Table == nil {
+				return nil
+			}
+			if name, ok := names[n.Table.Name]; ok {
+				replace(rw, &n.Table, &sqlparser.Ident{Name: name, Quoted: n.Table.Quoted, QuoteChar: n.Table.QuoteChar})
+			}
+		}
+		return nil
+	}), node)
+}
+
+// visitFunc is like sqlparser.VisitFunc, but also visits the result columns,
+// which are not walked into by sqlparser.
+type visitFunc func(sqlparser.Node) error
+
+func (fn visitFunc) Visit(node sqlparser.Node) (sqlparser.Visitor, error) {
+	if err := fn(node); err != nil {
+		return nil, err
+	}
+	if columns, ok := node.(*sqlparser.OutputNames); ok && columns != nil {
+		for _, column := range *columns {
+			if err := sqlparser.Walk(fn, column); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if q, ok := node.(*inSubquery); ok {
+		if err := sqlparser.Walk(fn, q.Select); err != nil {
+			return nil, err
+		}
+	}
+	return fn, nil
+}
+
+func (fn visitFunc) VisitEnd(sqlparser.Node) error { return nil }
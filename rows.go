@@ -0,0 +1,178 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// resultSet is a result set read from sharding tables and buffered in memory.
+type resultSet struct {
+	columns []string
+	types   []string
+	rows    [][]any
+}
+
+// readResultSet reads all rows and closes them, each row is counted by limit
+// when it's not nil.
+func readResultSet(rows *sql.Rows, limit *distinctLimit) (*resultSet, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	rs := &resultSet{columns: columns, types: make([]string, len(columns))}
+	if columnTypes, err := rows.ColumnTypes(); err == nil {
+		for i, ct := range columnTypes {
+			rs.types[i] = ct.DatabaseTypeName()
+		}
+	}
+
+	for rows.Next() {
+		values := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if err := limit.add(columns, values); err != nil {
+			return nil, err
+		}
+		rs.rows = append(rs.rows, values)
+	}
+
+	return rs, rows.Err()
+}
+
+// append appends the rows of other, the columns of both result sets must match.
+func (rs *resultSet) append(other *resultSet) error {
+	if len(rs.columns) != len(other.columns) {
+		return fmt.Errorf("sharding tables return different columns: %v and %v", rs.columns, other.columns)
+	}
+	rs.rows = append(rs.rows, other.rows...)
+	return nil
+}
+
+// The buffered result sets are handed to gorm through an in-memory
+// database/sql driver, since *sql.Rows and *sql.Row can't be built directly.
+var (
+	resultDBOnce sync.Once
+	resultDB     *sql.DB
+	resultSets   sync.Map
+	resultSeq    atomic.Int64
+)
+
+type pendingResult struct {
+	rs  *resultSet
+	err error
+}
+
+func storeResult(rs *resultSet, err error) int64 {
+	resultDBOnce.Do(func() {
+		resultDB = sql.OpenDB(resultConnector{})
+	})
+
+	id := resultSeq.Add(1)
+	resultSets.Store(id, pendingResult{rs: rs, err: err})
+	return id
+}
+
+// toRows convert a buffered result set to *sql.Rows.
+func toRows(ctx context.Context, rs *resultSet) (*sql.Rows, error) {
+	id := storeResult(rs, nil)
+	return resultDB.QueryContext(ctx, "", id)
+}
+
+// toRow convert a buffered result set or an error to *sql.Row.
+func toRow(ctx context.Context, rs *resultSet, err error) *sql.Row {
+	id := storeResult(rs, err)
+	return resultDB.QueryRowContext(ctx, "", id)
+}
+
+type resultConnector struct{}
+
+func (c resultConnector) Connect(context.Context) (driver.Conn, error) {
+	return resultConn{}, nil
+}
+
+func (c resultConnector) Driver() driver.Driver {
+	return resultDriver{}
+}
+
+type resultDriver struct{}
+
+func (d resultDriver) Open(string) (driver.Conn, error) {
+	return resultConn{}, nil
+}
+
+type resultConn struct{}
+
+var errResultConn = errors.New("sharding result connection only serves buffered results")
+
+func (c resultConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errResultConn
+}
+
+func (c resultConn) Close() error {
+	return nil
+}
+
+func (c resultConn) Begin() (driver.Tx, error) {
+	return nil, errResultConn
+}
+
+func (c resultConn) QueryContext(_ context.Context, _ string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) != 1 {
+		return nil, errResultConn
+	}
+	id, ok := args[0].Value.(int64)
+	if !ok {
+		return nil, errResultConn
+	}
+	v, ok := resultSets.LoadAndDelete(id)
+	if !ok {
+		return nil, errResultConn
+	}
+
+	result := v.(pendingResult)
+	if result.err != nil {
+		return nil, result.err
+	}
+	return &resultRows{rs: result.rs}, nil
+}
+
+type resultRows struct {
+	rs  *resultSet
+	pos int
+}
+
+func (r *resultRows) Columns() []string {
+	return r.rs.columns
+}
+
+func (r *resultRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.rs.types[index]
+}
+
+func (r *resultRows) Close() error {
+	return nil
+}
+
+func (r *resultRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rs.rows) {
+		return io.EOF
+	}
+	for i, v := range r.rs.rows[r.pos] {
+		dest[i] = v
+	}
+	r.pos++
+	return nil
+}
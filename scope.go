@@ -0,0 +1,445 @@
+package sharding
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+// scope is a SELECT, UPDATE or DELETE statement, or a subquery in it, like
+// `IN (SELECT ...)`, `EXISTS (SELECT ...)` or a derived table. The sharding
+// tables of each scope are routed by the conditions of the scope itself.
+type scope struct {
+	node      sqlparser.Node
+	parent    *scope
+	sel       *sqlparser.SelectStatement
+	condition sqlparser.Expr
+
+	// tables, the sharding tables in FROM of the scope, they are one table or binding tables.
+	tables     []*sqlparser.TableName
+	r          Config
+	qualifiers []string
+	// names, the names of the sharding tables without alias, which columns can be qualified by.
+	names []string
+
+	suffixes []string
+	keys     []*keyCondition
+	// inherit, the scope of binding tables the suffix is inherited from,
+	// when the scope doesn't restrict the sharding key.
+	inherit *scope
+	// union, the sharding table is replaced by UNION ALL of all suffixes.
+	union bool
+	// suffix, the suffix of the query being rewritten.
+	suffix string
+}
+
+// resolveScopes rewrite a statement with JOIN or subqueries, every scope is
+// routed separately. The statement is rewritten for each suffix of the outermost
+// scope, a subquery should be routed to one suffix, or inherit the suffix from
+// an outer scope of binding tables. Otherwise it's fanned out by UNION ALL when
+// fan out is enabled.
+func (s *Sharding) resolveScopes(opts routeOptions, stmt sqlparser.Statement, query string, args ...any) (ftQuery string, stQueries []shardQuery, tableName string, err error) {
+	ftQuery = query
+	stQueries = []shardQuery{{query: query, args: args}}
+
+	scopes, owner, err := s.parseScopes(stmt)
+	if err != nil {
+		return
+	}
+	for _, sc := range scopes {
+		if len(sc.tables) > 0 {
+			tableName = sc.tables[0].Name.Name
+			break
+		}
+	}
+	if tableName == "" {
+		return
+	}
+
+	root := scopes[0]
+	suffixes := []string{""}
+	if len(root.tables) > 0 {
+		_, isSelect := stmt.(*sqlparser.SelectStatement)
+		suffixes, root.keys, err = s.routeSuffixes(opts, root.r, root.tables[0].Name.Name, root.qualifiers, root.condition, isSelect, args...)
+		if err != nil {
+			return
+		}
+	}
+	for _, sc := range scopes[1:] {
+		if err = s.routeScope(opts, sc, args...); err != nil {
+			return
+		}
+	}
+
+	var move bool
+	if update, ok := stmt.(*sqlparser.UpdateStatement); ok && len(root.tables) > 0 {
+		if move, err = keyUpdate(root.r, update, root.qualifiers, suffixes, args); err != nil {
+			return
+		}
+	}
+
+	ftQuery = stmt.String()
+
+	var plan *mergePlan
+	if root.sel != nil && len(suffixes) > 1 {
+		base := &rewriter{}
+		defer base.restore()
+		if plan, args, err = s.planMerge(base, root.sel, root.r, args); err != nil {
+			return
+		}
+	}
+
+	stQueries = make([]shardQuery, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		rw := &rewriter{}
+		stArgs := args
+		if len(suffixes) > 1 {
+			stArgs, err = rewriteKeyConditions(rw, stmt, root.keys, suffix, root.r, args)
+			if err != nil {
+				return
+			}
+		}
+
+		root.suffix = suffix
+		if err = renameScopes(rw, scopes, owner); err != nil {
+			rw.restore()
+			return
+		}
+		var source string
+		if source, err = scopesSource(scopes); err != nil {
+			rw.restore()
+			return
+		}
+
+		q := shardQuery{source: source, suffix: suffix, query: stmt.String(), args: stArgs, merge: plan}
+		if move {
+			q.move = s.newKeyMove(rw, stmt.(*sqlparser.UpdateStatement), tableName, stArgs)
+		}
+		stQueries = append(stQueries, q)
+		rw.restore()
+	}
+	return
+}
+
+// parseScopes returns the scopes of the statement, the outermost first, and the
+// innermost scope each node belongs to.
+func (s *Sharding) parseScopes(stmt sqlparser.Statement) (scopes []*scope, owner map[sqlparser.Node]*scope, err error) {
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		sc := &scope{node: node}
+		var from []*sqlparser.TableName
+		switch n := node.(type) {
+		case *sqlparser.SelectStatement:
+			sc.sel, sc.condition = n, n.Condition
+			from = sourceTables(n.FromItems)
+		case *sqlparser.UpdateStatement:
+			sc.condition = n.Condition
+			from = []*sqlparser.TableName{n.TableName}
+		case *sqlparser.DeleteStatement:
+			sc.condition = n.Condition
+			from = []*sqlparser.TableName{n.TableName}
+		default:
+			return nil
+		}
+		scopes = append(scopes, sc)
+		sc.tables = from
+		return nil
+	}), stmt)
+	if len(scopes) == 0 {
+		return nil, nil, sqlparser.ErrNotImplemented
+	}
+
+	// the scopes are in preorder, so the inner scopes overwrite the owner of their nodes
+	owner = make(map[sqlparser.Node]*scope)
+	for _, sc := range scopes {
+		sc.parent = owner[sc.node]
+		_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+			owner[node] = sc
+			return nil
+		}), sc.node)
+
+		if err = s.shardingTables(sc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// shardingTables keeps the sharding tables in FROM of the scope, they should
+// be one table or binding tables.
+func (s *Sharding) shardingTables(sc *scope) error {
+	from := sc.tables
+	sc.tables = nil
+	for _, table := range from {
+		name := table.Name.Name
+		r, ok := s.configs[name]
+		if !ok {
+			continue
+		}
+
+		if len(sc.tables) == 0 {
+			sc.r = r
+		} else if first := sc.tables[0].Name.Name; first == name || !s.bound(first, name) {
+			return ErrJoinNotBinding
+		}
+		sc.tables = append(sc.tables, table)
+		sc.qualifiers = append(sc.qualifiers, name)
+		if table.Alias != nil {
+			sc.qualifiers = append(sc.qualifiers, table.Alias.Name)
+		} else {
+			sc.names = append(sc.names, name)
+		}
+	}
+	return nil
+}
+
+// routeScope routes a subquery scope.
+func (s *Sharding) routeScope(opts routeOptions, sc *scope, args ...any) error {
+	if len(sc.tables) == 0 {
+		return nil
+	}
+
+	var suffixes []string
+	var err error
+	// all sharding tables is only for the outermost scope
+	if opts.hint != nil && !opts.hint.all {
+		suffixes, err = opts.hint.suffixes(sc.r)
+	} else {
+		suffixes, _, err = s.nonInsertSuffixes(sc.r, sc.qualifiers, sc.condition, args...)
+	}
+	if errors.Is(err, ErrMissingShardingKey) || errors.Is(err, errMissingPrimaryKeyAlgorithm) {
+		for p := sc.parent; p != nil; p = p.parent {
+			if len(p.tables) > 0 && s.bound(p.tables[0].Name.Name, sc.tables[0].Name.Name) {
+				if p.union {
+					return ErrSubqueryNotRouted
+				}
+				sc.inherit = p
+				return nil
+			}
+		}
+		if !opts.fanOutEnabled(sc.r) {
+			return err
+		}
+		suffixes, err = sc.r.ShardingSuffixs(), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(suffixes) > 1 {
+		// only a single table in FROM can be replaced by UNION ALL
+		if len(sc.tables) > 1 || sc.sel == nil || sc.sel.FromItems != sqlparser.Source(sc.tables[0]) {
+			return ErrSubqueryNotRouted
+		}
+		sc.union = true
+	}
+	sc.suffixes = suffixes
+	return nil
+}
+
+// bound returns whether two sharding tables are binding tables.
+func (s *Sharding) bound(a, b string) bool {
+	ga, ok := s.bindings[a]
+	gb, ok2 := s.bindings[b]
+	return ok && ok2 && ga == gb
+}
+
+// renameScopes rename the sharding tables of every scope, and the columns
+// qualified by them, to the suffix of the scope.
+func renameScopes(rw *rewriter, scopes []*scope, owner map[sqlparser.Node]*scope) error {
+	for _, sc := range scopes[1:] {
+		switch {
+		case sc.inherit != nil:
+			sc.suffix = sc.inherit.suffix
+		case len(sc.suffixes) == 1:
+			sc.suffix = sc.suffixes[0]
+		}
+	}
+
+	for node, sc := range owner {
+		switch n := node.(type) {
+		case *sqlparser.TableName:
+			if sc.suffix != "" && slices.Contains(sc.tables, n) {
+				replace(rw, &n.Name, &sqlparser.Ident{Name: n.Name.Name + sc.suffix})
+			}
+		case *sqlparser.QualifiedRef:
+			if n.Table == nil {
+				continue
+			}
+			if decl := declaringScope(sc, n.Table.Name); decl != nil && decl.suffix != "" {
+				replace(rw, &n.Table, &sqlparser.Ident{Name: n.Table.Name + decl.suffix, Quoted: n.Table.Quoted, QuoteChar: n.Table.QuoteChar})
+			}
+		}
+	}
+
+	for _, sc := range scopes {
+		if sc.sel != nil && sc.sel.Hint != nil && sc.suffix != "" {
+			replace(rw, &sc.sel.Hint, &sqlparser.Hint{Value: renameHint(sc.sel.Hint.Value, sc.names, sc.suffix)})
+		}
+		if sc.union {
+			union, err := unionSource(sc.tables[0], sc.suffixes)
+			if err != nil {
+				return err
+			}
+			replace(rw, &sc.sel.FromItems, union)
+		}
+	}
+	return nil
+}
+
+// hintWordRegexp matches the words in a hint, which may be table names.
+var hintWordRegexp = regexp.MustCompile(`\w+`)
+
+// renameHint rename the table names in hint, like `/*+ INDEX(orders idx_user_id) */`.
+func renameHint(hint string, names []string, suffix string) string {
+	return hintWordRegexp.ReplaceAllStringFunc(hint, func(word string) string {
+		if slices.Contains(names, word) {
+			return word + suffix
+		}
+		return word
+	})
+}
+
+// declaringScope returns the nearest scope has a sharding table named name.
+func declaringScope(sc *scope, name string) *scope {
+	for ; sc != nil; sc = sc.parent {
+		if slices.Contains(sc.names, name) {
+			return sc
+		}
+	}
+	return nil
+}
+
+// unionSource returns `(SELECT * FROM table_0 UNION ALL SELECT * FROM table_1 ...) AS table`.
+func unionSource(table *sqlparser.TableName, suffixes []string) (sqlparser.Source, error) {
+	name := table.Name.Name
+	selects := make([]string, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		selects = append(selects, "SELECT * FROM "+name+suffix)
+	}
+
+	stmt, err := sqlparser.NewParser(strings.NewReader(strings.Join(selects, " UNION ALL "))).ParseStatement()
+	if err != nil {
+		return nil, err
+	}
+	src, ok := stmt.(sqlparser.Source)
+	if !ok {
+		return nil, sqlparser.ErrNotImplemented
+	}
+
+	alias := table.Alias
+	if alias == nil {
+		alias = &sqlparser.Ident{Name: name, Quoted: table.Name.Quoted, QuoteChar: table.Name.QuoteChar}
+	}
+	return &sqlparser.ParenSource{X: src, Alias: alias}, nil
+}
+
+// hasSubquery returns whether there is SELECT nested in node.
+func hasSubquery(node sqlparser.Node) (found bool) {
+	_ = sqlparser.Walk(visitFunc(func(n sqlparser.Node) error {
+		if _, ok := n.(*sqlparser.SelectStatement); ok && n != node {
+			found = true
+		}
+		return nil
+	}), node)
+	return
+}
+
+// inSubquery is the subquery of `x IN (SELECT ...)`, which the parser doesn't
+// support. It's parsed as `x IN (EXISTS (SELECT ...))` and printed without EXISTS.
+type inSubquery struct {
+	*sqlparser.Exists
+}
+
+func (q *inSubquery) String() string {
+	return q.Select.String()
+}
+
+// parseStatement parses query, the subqueries of `IN (SELECT ...)` are parsed
+// into inSubquery, so they are routed as scopes.
+func parseStatement(query string) (sqlparser.Statement, error) {
+	stmt, err := sqlparser.NewParser(strings.NewReader(query)).ParseStatement()
+	if err == nil {
+		return stmt, nil
+	}
+	wrapped, ok := wrapInSelect(query)
+	if !ok {
+		return nil, err
+	}
+	stmt, wrappedErr := sqlparser.NewParser(strings.NewReader(wrapped)).ParseStatement()
+	if wrappedErr != nil {
+		return nil, err
+	}
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		if n, ok := node.(*sqlparser.BinaryExpr); ok && (n.Op == sqlparser.IN || n.Op == sqlparser.NOTIN) {
+			if list, ok := n.Y.(*sqlparser.Exprs); ok && len(list.Exprs) == 1 {
+				if exists, ok := list.Exprs[0].(*sqlparser.Exists); ok && !exists.Not {
+					list.Exprs[0] = &inSubquery{exists}
+				}
+			}
+		}
+		return nil
+	}), stmt)
+	return stmt, nil
+}
+
+// wrapInSelect rewrites `IN (SELECT ...)` to `IN (EXISTS (SELECT ...))`. The
+// tokens are read by the lexer of the parser, so the literals and comments are
+// not rewritten. It returns false when there is nothing to rewrite, or the query
+// has `IN (EXISTS ...` already, which would be mistaken for a rewritten one.
+func wrapInSelect(query string) (string, bool) {
+	type insertion struct {
+		pos  int
+		text string
+	}
+	var insertions []insertion
+	// opens, whether each open parenthesis is the one of `IN (SELECT`.
+	var opens []bool
+	var prev [2]sqlparser.Token
+	lexer := sqlparser.NewLexer(strings.NewReader(query))
+	for {
+		pos, tok, _ := lexer.Lex()
+		if tok == sqlparser.EOF {
+			break
+		}
+		switch tok {
+		case sqlparser.MLCOMMENT:
+			continue
+		case sqlparser.LP:
+			opens = append(opens, false)
+		case sqlparser.RP:
+			if len(opens) > 0 {
+				if opens[len(opens)-1] {
+					insertions = append(insertions, insertion{pos.Offset, ")"})
+				}
+				opens = opens[:len(opens)-1]
+			}
+		case sqlparser.SELECT, sqlparser.EXISTS:
+			if prev == [2]sqlparser.Token{sqlparser.IN, sqlparser.LP} {
+				if tok == sqlparser.EXISTS {
+					return query, false
+				}
+				opens[len(opens)-1] = true
+				insertions = append(insertions, insertion{pos.Offset, "EXISTS ("})
+			}
+		}
+		prev = [2]sqlparser.Token{prev[1], tok}
+	}
+	if len(insertions) == 0 {
+		return query, false
+	}
+
+	// the offsets of the lexer are counted in runes
+	runes := []rune(query)
+	var b strings.Builder
+	last := 0
+	for _, in := range insertions {
+		b.WriteString(string(runes[last:in.pos]))
+		b.WriteString(in.text)
+		last = in.pos
+	}
+	b.WriteString(string(runes[last:]))
+	return b.String(), true
+}
@@ -0,0 +1,50 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+	"github.com/longbridgeapp/sqlparser"
+)
+
+func TestParseInSelect(t *testing.T) {
+	query := `SELECT * FROM orders WHERE id IN ( select order_id FROM order_items WHERE name IN ('a)', 'IN (SELECT') AND id NOT IN (SELECT id FROM t))`
+	stmt, err := parseStatement(query)
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT * FROM orders WHERE id IN (SELECT order_id FROM order_items WHERE name IN ('a)', 'IN (SELECT') AND id NOT IN (SELECT id FROM t))`, stmt.String())
+	assert.Equal(t, true, hasSubquery(stmt.(*sqlparser.SelectStatement).Condition))
+
+	query = `SELECT * FROM orders WHERE product = 'IN (SELECT' /* IN (SELECT */ AND id IN (1, 2)`
+	_, ok := wrapInSelect(query)
+	assert.Equal(t, false, ok)
+
+	_, err = parseStatement(`SELECT * FROM orders WHERE id IN (EXISTS (SELECT 1)) AND id IN (SELECT id FROM t)`)
+	assert.Error(t, err)
+}
+
+func TestUnparsedShardingQuery(t *testing.T) {
+	s := &Sharding{configs: map[string]Config{"orders": {}}}
+	for query, unparsed := range map[string]bool{
+		`SELECT * FROM "orders" WHERE "user_id" = 101::bigint`:                                     true,
+		`SELECT * FROM items JOIN public.orders o ON o.id = items.order_id WHERE o.id = 1::bigint`: true,
+		`SELECT * FROM items, orders WHERE orders.id = 1::bigint`:                                  true,
+		`SELECT * FROM items WHERE name = 'orders' AND id = 1::bigint`:                             false,
+		`SELECT orders FROM items WHERE id = 1::bigint`:                                            false,
+		`SELECT * FROM "orders" WHERE "user_id" = 101 FOR UPDATE`:                                  false,
+		`SELECT * FROM "orders" WHERE NOT ("user_id" = 101 AND id = 1::bigint)`:                    false,
+		`SELECT * FROM "orders" WHERE "product" ILIKE 'ipad'`:                                      false,
+		`SELECT * FROM "orders" WHERE created_at > NOW() - INTERVAL '1 day'`:                       false,
+		`SELECT /* nosharding */ * FROM "orders" WHERE "user_id" = 101::bigint`:                    false,
+	} {
+		assert.Equal(t, unparsed, s.unparsedShardingQuery(query), query)
+	}
+}
+
+func TestResolveInSelect(t *testing.T) {
+	s := Register(Config{ShardingKey: "user_id", NumberOfShards: 4, PrimaryKeyGenerator: PKCustom, PrimaryKeyGeneratorFn: func(int64) int64 { return 0 }}, "orders", "order_items")
+	assert.Equal[error](t, nil, s.compile())
+
+	_, stQueries, _, err := s.resolve(routeOptions{}, `SELECT * FROM orders WHERE user_id = ? AND product <> 'IN (EXISTS (' AND id IN (SELECT order_id FROM order_items WHERE user_id = ?)`, 101, 102)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, `SELECT * FROM orders_1 WHERE user_id = ? AND product <> 'IN (EXISTS (' AND id IN (SELECT order_id FROM order_items_2 WHERE user_id = ?)`, stQueries[0].query)
+}
@@ -1,9 +1,11 @@
 package sharding
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,13 +17,48 @@ import (
 )
 
 var (
-	ErrMissingShardingKey = errors.New("sharding key or id required, and use operator =")
+	ErrMissingShardingKey = errors.New("sharding key or id required, and use operator = or IN")
 	ErrInvalidID          = errors.New("invalid id format")
-	ErrInsertDiffSuffix   = errors.New("can not insert different suffix table in one query ")
+	// Deprecated: rows of different sharding tables are inserted by one query for each table.
+	ErrInsertDiffSuffix = errors.New("can not insert different suffix table in one query ")
+	ErrJoinNotBinding   = errors.New("sharding tables in JOIN should be binding tables")
+	// ErrSubqueryNotRouted occurs when a subquery of binding tables is routed to
+	// more than one sharding table, which can't be joined in one query.
+	ErrSubqueryNotRouted = errors.New("subquery can not be routed to one sharding table")
+	// ErrDistinctLimitExceeded occurs when the distinct values merged from sharding
+	// tables are more than Config.MaxDistinctValues.
+	ErrDistinctLimitExceeded = errors.New("too many distinct values to merge from sharding tables")
+	// ErrCrossDataSource occurs when the sharding tables of one query are in different data sources.
+	ErrCrossDataSource = errors.New("sharding tables in one query should be in the same data source")
+	// ErrCrossDataSourceTx occurs when a statement in a transaction is routed to
+	// a data source other than the database of the transaction.
+	ErrCrossDataSourceTx = errors.New("transaction can not be across data sources")
+	// ErrInvalidSuffix occurs when the suffix of Shard hint is not in ShardingSuffixs.
+	ErrInvalidSuffix = errors.New("suffix is not in ShardingSuffixs")
+	// ErrUpdateShardingKey occurs when a statement sets the sharding key, the row
+	// would be in a wrong sharding table. An UPDATE moves the rows instead when
+	// Config.MoveOnKeyUpdate is enabled.
+	ErrUpdateShardingKey = errors.New("sharding key can not be updated")
+	// ErrTxInDoubt occurs when some branches of a transaction of two-phase commit
+	// fail to commit after all branches are prepared, the commit is logged, and
+	// they are committed by Sharding.Recover, when the plugin is initialized or
+	// Recover is called.
+	ErrTxInDoubt = errors.New("transaction is committed in doubt, some branches are not committed yet")
+	// ErrNullShardingKey occurs when the sharding key is NULL and Config.NullKeyPolicy is NullKeyError.
+	ErrNullShardingKey = errors.New("sharding key is NULL")
+
+	// ErrUnparsedQuery occurs when a query of sharding tables can't be parsed, it
+	// can't be routed to the sharding tables.
+	ErrUnparsedQuery = errors.New("query of sharding tables can not be parsed")
+
+	errMissingPrimaryKeyAlgorithm = errors.New("there is not sharding key and ShardingAlgorithmByPrimaryKey is not configured")
+	errMultiShardInsertID         = errors.New("the ids generated by several sharding tables can not be returned as one last insert id")
 )
 
 var (
 	ShardingIgnoreStoreKey = "sharding_ignore"
+	ShardingFanOutStoreKey = "sharding_fan_out"
+	ShardingHintStoreKey   = "sharding_hint"
 )
 
 type Sharding struct {
@@ -31,8 +68,21 @@ type Sharding struct {
 	querys         sync.Map
 	snowflakeNodes []*snowflake.Node
 
-	_config Config
-	_tables []any
+	_rules      []rule
+	_bindings   [][]any
+	_broadcasts []any
+
+	// bindings, the binding group index of each binding table.
+	bindings   map[string]int
+	broadcasts map[string]bool
+	// sources, the DB of each data source, except the default one.
+	sources map[string]*gorm.DB
+
+	// txLog, the log of two-phase commit, it's disabled when nil.
+	txLog TxLog
+	// txMutex, the transactions of two-phase commit hold the read lock, and
+	// Recover holds the write lock.
+	txMutex sync.RWMutex
 
 	mutex sync.RWMutex
 }
@@ -46,14 +96,54 @@ type Config struct {
 	// For example, for a product order table, you may want to split the rows by `user_id`.
 	ShardingKey string
 
+	// ShardingKeys specifies the columns of a composite sharding key, used instead of
+	// ShardingKey. For example, `tenant_id` and `region`. ShardingAlgorithm receives
+	// a CompositeKey of their values, and a query is routed only when all of them
+	// are given.
+	ShardingKeys []string
+
 	// NumberOfShards specifies how many tables you want to sharding.
 	NumberOfShards uint
 
+	// When FanOut enabled, SELECT queries without sharding key will be executed on
+	// all sharding tables from ShardingSuffixs, and the results are combined.
+	// It can also be enabled or disabled for one query by ShardingFanOutStoreKey.
+	//
+	// 	db.Set(sharding.ShardingFanOutStoreKey, true).Model(&Order{}).Find(&orders)
+	FanOut bool
+
+	// NullKeyPolicy specifies how to route a NULL sharding key, like a nil
+	// pointer or an invalid sql.NullInt64. Defaults to NullKeyError.
+	NullKeyPolicy NullKeyPolicy
+
+	// NullKeySuffix specifies the suffix of the sharding table of NULL sharding
+	// key when NullKeyPolicy is NullKeyToSuffix, it should be in ShardingSuffixs.
+	NullKeySuffix string
+
+	// When MoveOnKeyUpdate enabled, an UPDATE which sets the sharding key moves
+	// the rows to the sharding tables of the new key, they are read, deleted and
+	// inserted with the same primary key in a transaction, which is across data
+	// sources only by two-phase commit. Otherwise the UPDATE returns
+	// ErrUpdateShardingKey, unless the rows stay in the same table.
+	MoveOnKeyUpdate bool
+
+	// MaxDistinctValues limits the distinct values or rows kept in memory when
+	// merging `SELECT DISTINCT` and `COUNT(DISTINCT x)` from sharding tables,
+	// ErrDistinctLimitExceeded is returned once the rows read exceed it.
+	// Defaults to 100000.
+	MaxDistinctValues int
+
 	// tableFormat specifies the sharding table suffix format.
 	tableFormat string
+	// primaryKey, the primary key column of the table, "id" by default.
+	primaryKey string
+	// suffixs, the suffixes of the built-in algorithm, which the table index is
+	// the position in, nil when the suffixes are integers of tableFormat.
+	suffixs []string
 
 	// ShardingAlgorithm specifies a function to generate the sharding
-	// table's suffix by the column value.
+	// table's suffix by the column value. The value is normalized, integers
+	// and numeric strings are int64, see the README for the others.
 	// For example, this function implements a mod sharding algorithm.
 	//
 	// 	func(value any) (suffix string, err error) {
@@ -86,6 +176,54 @@ type Config struct {
 	//	}
 	ShardingAlgorithmByPrimaryKey func(id int64) (suffix string)
 
+	// ShardingAlgorithmByRange specifies a function to generate the sharding
+	// table's suffixes which a range of the sharding key maps to. Used to route
+	// queries with `BETWEEN`, `<`, `<=`, `>` and `>=` conditions on the sharding key.
+	// For example, this function maps a range of user_id to tables of 1000 users.
+	//
+	// 	func(r sharding.Range) (suffixs []string, err error) {
+	//		min, max := r.Min.(int64), r.Max.(int64)
+	//		for i := min / 1000; i <= max/1000; i++ {
+	//			suffixs = append(suffixs, fmt.Sprintf("_%02d", i))
+	//		}
+	//		return
+	//	}
+	ShardingAlgorithmByRange func(r Range) (suffixs []string, err error)
+
+	// TimeSharding specifies the built-in algorithm to shard by a time column,
+	// it's used as ShardingAlgorithm, ShardingSuffixs and ShardingAlgorithmByRange
+	// when they are not specified.
+	TimeSharding *TimeSharding
+
+	// HashRing specifies the built-in consistent hashing algorithm, it's used as
+	// ShardingAlgorithm and ShardingSuffixs when they are not specified.
+	HashRing *HashRing
+
+	// RangeSharding specifies the built-in algorithm to shard by ranges of the
+	// sharding key, it's used as ShardingAlgorithm, ShardingSuffixs and
+	// ShardingAlgorithmByRange when they are not specified.
+	RangeSharding *RangeSharding
+
+	// ListSharding specifies the built-in algorithm to shard by lists of values
+	// of the sharding key, it's used as ShardingAlgorithm and ShardingSuffixs
+	// when they are not specified.
+	ListSharding *ListSharding
+
+	// DataSources specifies the databases the sharding tables are distributed to,
+	// by name. The sharding tables are in the database of gorm DB when it's empty.
+	DataSources map[string]gorm.Dialector
+
+	// DataSourceAlgorithm specifies a function to choose the data source of a
+	// sharding table by its suffix, every sharding table is in one data source,
+	// "" for the database of gorm DB. Required when use DataSources.
+	// For example, this function put orders_00 ... orders_15 to db_0 ... db_3.
+	//
+	// 	func(suffix string) (source string, err error) {
+	//		i, err := strconv.Atoi(strings.TrimPrefix(suffix, "_"))
+	//		return fmt.Sprintf("db_%d", i%4), err
+	//	}
+	DataSourceAlgorithm func(suffix string) (source string, err error)
+
 	// PrimaryKeyGenerator specifies the primary key generate algorithm.
 	// Used only when insert and the record does not contains an id field.
 	// Options are PKSnowflake, PKPGSequence and PKCustom.
@@ -104,30 +242,53 @@ type Config struct {
 }
 
 func Register(config Config, tables ...any) *Sharding {
-	return &Sharding{
-		_config: config,
-		_tables: tables,
-	}
+	return (&Sharding{}).Register(config, tables...)
+}
+
+// rule is a Config and the tables it applies to.
+type rule struct {
+	config Config
+	tables []any
+}
+
+// Register registers more tables with another Config to the plugin, every
+// table can have its own sharding key, algorithm and primary key generator.
+// One plugin handles all of them, a second plugin can't be used by a gorm DB.
+//
+//	db.Use(sharding.Register(orderConfig, &Order{}).Register(eventConfig, &Event{}))
+func (s *Sharding) Register(config Config, tables ...any) *Sharding {
+	s._rules = append(s._rules, rule{config: config, tables: tables})
+	return s
 }
 
 func (s *Sharding) compile() error {
 	if s.configs == nil {
 		s.configs = make(map[string]Config)
 	}
-	for _, table := range s._tables {
-		if t, ok := table.(string); ok {
-			s.configs[t] = s._config
-		} else {
-			stmt := &gorm.Statement{DB: s.DB}
-			if err := stmt.Parse(table); err == nil {
-				s.configs[stmt.Table] = s._config
-			} else {
+	registered := make(map[string]bool)
+	for _, rule := range s._rules {
+		for _, table := range rule.tables {
+			t, err := s.tableName(table)
+			if err != nil {
 				return err
 			}
+			if registered[t] {
+				return fmt.Errorf("sharding table %s is registered more than once", t)
+			}
+			registered[t] = true
+			c := rule.config
+			c.primaryKey = s.primaryKey(table)
+			s.configs[t] = c
 		}
 	}
 
 	for t, c := range s.configs {
+		if c.ShardingKey != "" && len(c.ShardingKeys) > 0 {
+			return errors.New("specify ShardingKey or ShardingKeys, not both")
+		}
+		if len(c.DataSources) > 0 && c.DataSourceAlgorithm == nil {
+			return errors.New("DataSourceAlgorithm is required when use DataSources")
+		}
 		if c.NumberOfShards > 1024 && c.PrimaryKeyGenerator == PKSnowflake {
 			panic("Snowflake NumberOfShards should less than 1024")
 		}
@@ -162,37 +323,102 @@ func (s *Sharding) compile() error {
 			return errors.New("PrimaryKeyGenerator can only be one of PKSnowflake, PKPGSequence, PKMySQLSequence and PKCustom")
 		}
 
+		var timeKey bool
+		if c.TimeSharding != nil {
+			if err := c.TimeSharding.compile(); err != nil {
+				return err
+			}
+			if c.ShardingAlgorithm == nil {
+				c.ShardingAlgorithm = c.TimeSharding.ShardingAlgorithm
+				timeKey = true
+			}
+			if c.ShardingSuffixs == nil {
+				c.ShardingSuffixs = c.TimeSharding.ShardingSuffixs
+			}
+			if c.ShardingAlgorithmByRange == nil {
+				c.ShardingAlgorithmByRange = c.TimeSharding.ShardingAlgorithmByRange
+			}
+		}
+
+		if c.NumberOfShards < 10 {
+			c.tableFormat = "_%01d"
+		} else if c.NumberOfShards < 100 {
+			c.tableFormat = "_%02d"
+		} else if c.NumberOfShards < 1000 {
+			c.tableFormat = "_%03d"
+		} else if c.NumberOfShards < 10000 {
+			c.tableFormat = "_%04d"
+		}
+
+		if c.HashRing != nil {
+			if len(c.HashRing.Suffixs) == 0 {
+				for i := 0; i < int(c.NumberOfShards); i++ {
+					c.HashRing.Suffixs = append(c.HashRing.Suffixs, fmt.Sprintf(c.tableFormat, i))
+				}
+			}
+			if err := c.HashRing.compile(); err != nil {
+				return err
+			}
+			if c.ShardingAlgorithm == nil {
+				c.ShardingAlgorithm = c.HashRing.ShardingAlgorithm
+			}
+			if c.ShardingSuffixs == nil {
+				c.ShardingSuffixs = c.HashRing.ShardingSuffixs
+			}
+		}
+
+		if c.RangeSharding != nil {
+			if err := c.RangeSharding.compile(); err != nil {
+				return err
+			}
+			if c.ShardingAlgorithm == nil {
+				c.ShardingAlgorithm = c.RangeSharding.ShardingAlgorithm
+			}
+			if c.ShardingSuffixs == nil {
+				c.ShardingSuffixs = c.RangeSharding.ShardingSuffixs
+			}
+			if c.ShardingAlgorithmByRange == nil {
+				c.ShardingAlgorithmByRange = c.RangeSharding.ShardingAlgorithmByRange
+			}
+		}
+
+		if c.ListSharding != nil {
+			if err := c.ListSharding.compile(); err != nil {
+				return err
+			}
+			if c.ShardingAlgorithm == nil {
+				c.ShardingAlgorithm = c.ListSharding.ShardingAlgorithm
+			}
+			if c.ShardingSuffixs == nil {
+				c.ShardingSuffixs = c.ListSharding.ShardingSuffixs
+			}
+		}
+
 		if c.ShardingAlgorithm == nil {
 			if c.NumberOfShards == 0 {
 				return errors.New("specify NumberOfShards or ShardingAlgorithm")
 			}
-			if c.NumberOfShards < 10 {
-				c.tableFormat = "_%01d"
-			} else if c.NumberOfShards < 100 {
-				c.tableFormat = "_%02d"
-			} else if c.NumberOfShards < 1000 {
-				c.tableFormat = "_%03d"
-			} else if c.NumberOfShards < 10000 {
-				c.tableFormat = "_%04d"
-			}
 			c.ShardingAlgorithm = func(value any) (suffix string, err error) {
-				id := 0
-				switch value := value.(type) {
-				case int:
-					id = value
+				key, err := normalizeKey(value)
+				if err != nil {
+					return "", err
+				}
+				var id int64
+				switch key := key.(type) {
 				case int64:
-					id = int(value)
+					id = key
 				case string:
-					id, err = strconv.Atoi(value)
-					if err != nil {
-						id = int(crc32.ChecksumIEEE([]byte(value)))
-					}
+					id = int64(crc32.ChecksumIEEE([]byte(key)))
+				case CompositeKey:
+					id = int64(crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v", []any(key)))))
 				default:
-					return "", fmt.Errorf("default algorithm only support integer and string column," +
+					return "", fmt.Errorf("default algorithm only support integer, decimal and string column," +
 						"if you use other type, specify you own ShardingAlgorithm")
 				}
 
-				return fmt.Sprintf(c.tableFormat, id%int(c.NumberOfShards)), nil
+				// negative keys are in the tables of non-negative remainders
+				n := int64(c.NumberOfShards)
+				return fmt.Sprintf(c.tableFormat, (id%n+n)%n), nil
 			}
 		}
 
@@ -209,17 +435,56 @@ func (s *Sharding) compile() error {
 			}
 		}
 
-		if c.ShardingAlgorithmByPrimaryKey == nil {
-			if c.PrimaryKeyGenerator == PKSnowflake {
-				c.ShardingAlgorithmByPrimaryKey = func(id int64) (suffix string) {
-					return fmt.Sprintf(c.tableFormat, snowflake.ParseInt64(id).Node())
-				}
+		if err := c.compileKey(!timeKey); err != nil {
+			return err
+		}
+
+		if c.TimeSharding != nil || c.HashRing != nil || c.RangeSharding != nil || c.ListSharding != nil {
+			c.suffixs = c.ShardingSuffixs()
+			if c.PrimaryKeyGenerator == PKSnowflake && len(c.suffixs) > 1024 {
+				return fmt.Errorf("sharding table %s has %d suffixs, Snowflake supports 1024 tables at most", t, len(c.suffixs))
+			}
+		}
+
+		if c.ShardingAlgorithmByPrimaryKey == nil && c.PrimaryKeyGenerator == PKSnowflake {
+			c.ShardingAlgorithmByPrimaryKey = func(id int64) (suffix string) {
+				return c.indexSuffix(snowflake.ParseInt64(id).Node())
 			}
 		}
+
+		if c.MaxDistinctValues == 0 {
+			c.MaxDistinctValues = 100000
+		}
 		s.configs[t] = c
 	}
 
-	return nil
+	if err := s.compileBindings(); err != nil {
+		return err
+	}
+	return s.compileBroadcasts()
+}
+
+// tableName returns the table name of a table name string or a model.
+func (s *Sharding) tableName(table any) (string, error) {
+	if t, ok := table.(string); ok {
+		return t, nil
+	}
+	stmt := &gorm.Statement{DB: s.DB}
+	if err := stmt.Parse(table); err != nil {
+		return "", err
+	}
+	return stmt.Table, nil
+}
+
+// primaryKey returns the primary key column of a model, "id" for a table name.
+func (s *Sharding) primaryKey(table any) string {
+	if _, ok := table.(string); !ok {
+		stmt := &gorm.Statement{DB: s.DB}
+		if err := stmt.Parse(table); err == nil && stmt.Schema.PrioritizedPrimaryField != nil {
+			return stmt.Schema.PrioritizedPrimaryField.DBName
+		}
+	}
+	return "id"
 }
 
 // Name plugin name for Gorm plugin interface
@@ -270,7 +535,20 @@ func (s *Sharding) Initialize(db *gorm.DB) error {
 		s.snowflakeNodes[i] = n
 	}
 
-	return s.compile()
+	if err := s.compile(); err != nil {
+		return err
+	}
+	if err := s.openDataSources(); err != nil {
+		return err
+	}
+
+	if s.txLog != nil {
+		pool := &txPool{ConnPool: db.ConnPool, sharding: s}
+		db.ConnPool = pool
+		db.Statement.ConnPool = pool
+		return s.Recover(context.Background())
+	}
+	return nil
 }
 
 func (s *Sharding) registerCallbacks(db *gorm.DB) {
@@ -286,31 +564,99 @@ func (s *Sharding) switchConn(db *gorm.DB) {
 	// Support ignore sharding in some case, like:
 	// When DoubleWrite is enabled, we need to query database schema
 	// information by table name during the migration.
-	if _, ok := db.Get(ShardingIgnoreStoreKey); !ok {
-		s.mutex.Lock()
-		if db.Statement.ConnPool != nil {
-			s.ConnPool = &ConnPool{ConnPool: db.Statement.ConnPool, sharding: s}
-			db.Statement.ConnPool = s.ConnPool
+	if db.Statement.ConnPool == nil {
+		return
+	}
+	// the ConnPool switched already, or the ConnPool of gorm DB for two-phase commit
+	connPool := db.Statement.ConnPool
+	switch pool := connPool.(type) {
+	case *ConnPool:
+		connPool = pool.ConnPool
+	case *txPool:
+		connPool = pool.ConnPool
+	}
+
+	if _, ok := db.Get(ShardingIgnoreStoreKey); ok {
+		db.Statement.ConnPool = connPool
+		return
+	}
+	s.mutex.Lock()
+	s.ConnPool = &ConnPool{ConnPool: connPool, sharding: s, options: statementOptions(db)}
+	db.Statement.ConnPool = s.ConnPool
+	s.mutex.Unlock()
+}
+
+// routeOptions are the routing options of one statement.
+type routeOptions struct {
+	// fanOut overrides Config.FanOut when not nil.
+	fanOut *bool
+	// hint overrides the routing by conditions when not nil.
+	hint *Hint
+}
+
+func statementOptions(db *gorm.DB) (opts routeOptions) {
+	if v, ok := db.Get(ShardingFanOutStoreKey); ok {
+		if fanOut, ok := v.(bool); ok {
+			opts.fanOut = &fanOut
 		}
-		s.mutex.Unlock()
 	}
+	if v, ok := db.Get(ShardingHintStoreKey); ok {
+		if hint, ok := v.(Hint); ok {
+			opts.hint = &hint
+		}
+	}
+	return
 }
 
-// resolve split the old query to full table query and sharding table query
-func (s *Sharding) resolve(query string, args ...any) (ftQuery, stQuery, tableName string, err error) {
+func (opts routeOptions) fanOutEnabled(r Config) bool {
+	if opts.hint != nil && opts.hint.all {
+		return true
+	}
+	if opts.fanOut != nil {
+		return *opts.fanOut
+	}
+	return r.FanOut
+}
+
+// shardQuery is a query rewritten for one sharding table.
+type shardQuery struct {
+	// source, the data source the query is executed on.
+	source string
+	suffix string
+	query  string
+	args   []any
+	// rows, the indexes of the inserted rows in the original INSERT.
+	rows []int
+	// merge, how to merge the results of the queries on sharding tables.
+	merge *mergePlan
+	// insert, how to insert the rows of the SELECT of INSERT ... SELECT.
+	insert *insertSelect
+	// move, how to move the rows updated to the sharding tables of the new key.
+	move *keyMove
+	// broadcast, the query writes a broadcast table, only the result of the
+	// first data source is returned.
+	broadcast bool
+}
+
+// resolve split the old query to full table query and sharding table queries,
+// one for each sharding table the query touches.
+func (s *Sharding) resolve(opts routeOptions, query string, args ...any) (ftQuery string, stQueries []shardQuery, tableName string, err error) {
 	ftQuery = query
-	stQuery = query
+	stQueries = []shardQuery{{query: query, args: args}}
 	if len(s.configs) == 0 {
 		return
 	}
 
-	expr, err := sqlparser.NewParser(strings.NewReader(query)).ParseStatement()
+	insertQuery, upsert := splitUpsert(query)
+	expr, err := parseStatement(insertQuery)
 	if err != nil {
-		return ftQuery, stQuery, tableName, nil
+		if s.unparsedShardingQuery(query) {
+			return ftQuery, stQueries, tableName, fmt.Errorf("%w: %v", ErrUnparsedQuery, err)
+		}
+		return ftQuery, stQueries, tableName, nil
 	}
 
 	var table *sqlparser.TableName
-	var condition sqlparser.Expr
 	var isInsert bool
 	var insertNames []*sqlparser.Ident
 	var insertExpressions []*sqlparser.Exprs
@@ -318,15 +664,14 @@ func (s *Sharding) resolve(query string, args ...any) (ftQuery, stQuery, tableNa
 
 	switch stmt := expr.(type) {
 	case *sqlparser.SelectStatement:
-		tbl, ok := stmt.FromItems.(*sqlparser.TableName)
-		if !ok {
-			return
-		}
 		if stmt.Hint != nil && stmt.Hint.Value == "nosharding" {
 			return
 		}
+		tbl, ok := stmt.FromItems.(*sqlparser.TableName)
+		if !ok {
+			return s.resolveScopes(opts, stmt, query, args...)
+		}
 		table = tbl
-		condition = stmt.Condition
 	case *sqlparser.InsertStatement:
 		table = stmt.TableName
 		isInsert = true
@@ -334,125 +679,184 @@ func (s *Sharding) resolve(query string, args ...any) (ftQuery, stQuery, tableNa
 		insertExpressions = stmt.Expressions
 		insertStmt = stmt
 	case *sqlparser.UpdateStatement:
-		condition = stmt.Condition
 		table = stmt.TableName
 	case *sqlparser.DeleteStatement:
-		condition = stmt.Condition
 		table = stmt.TableName
 	default:
-		return ftQuery, stQuery, "", sqlparser.ErrNotImplemented
+		return ftQuery, stQueries, "", sqlparser.ErrNotImplemented
 	}
 
 	tableName = table.Name.Name
+	if s.broadcasts[tableName] {
+		_, isSelect := expr.(*sqlparser.SelectStatement)
+		switch {
+		case !s.hasShardingTable(expr):
+			if !isSelect {
+				stQueries = s.broadcastQueries(query, args)
+			}
+			return
+		case !isSelect && !isInsert:
+			// the rows of sharding tables are only in one data source
+			return ftQuery, stQueries, tableName, fmt.Errorf("%w: broadcast table %s can not be written by sharding tables", ErrCrossDataSource, tableName)
+		}
+	}
+
+	if !isInsert {
+		return s.resolveScopes(opts, expr, query, args...)
+	}
+	if insertStmt.Query != nil {
+		return s.resolveInsertSelect(opts, insertStmt, upsert, query, args...)
+	}
+
 	r, ok := s.configs[tableName]
 	if !ok {
 		return
 	}
+	if err = checkUpsert(r, insertStmt, upsert); err != nil {
+		return
+	}
+	if upsert != nil {
+		upsert.binds = bindCount(insertStmt)
+	}
 
-	var suffix string
-	if isInsert {
-		var newTable *sqlparser.TableName
-		for _, insertExpression := range insertExpressions {
+	// rows of each sharding table, in order of appearance
+	var suffixes []string
+	var suffixRows [][]int
+	for i, insertExpression := range insertExpressions {
+		var suffix string
+		if opts.hint != nil {
+			suffix, err = opts.hint.insertSuffix(r)
+		} else {
 			var value any
 			var id int64
 			var keyFind bool
-			columnNames := insertNames
-			insertValues := insertExpression.Exprs
-			value, id, keyFind, err = s.insertValue(r.ShardingKey, insertNames, insertValues, args...)
-			if err != nil {
-				return
-			}
-
-			var subSuffix string
-			subSuffix, err = getSuffix(value, id, keyFind, r)
+			value, id, keyFind, err = s.insertValue(r.shardingKeys(), insertNames, insertExpression.Exprs, args...)
 			if err != nil {
 				return
 			}
+			suffix, err = getSuffix(value, id, keyFind, r)
+		}
+		if err != nil {
+			return
+		}
 
-			if suffix != "" && suffix != subSuffix {
-				err = ErrInsertDiffSuffix
-				return
-			}
-
-			suffix = subSuffix
-
-			newTable = &sqlparser.TableName{Name: &sqlparser.Ident{Name: tableName + suffix}}
-
-			fillID := true
-			if isInsert {
-				for _, name := range insertNames {
-					if name.Name == "id" {
-						fillID = false
-						break
-					}
-				}
-				suffixWord := strings.Replace(suffix, "_", "", 1)
-				tblIdx, err := strconv.Atoi(suffixWord)
-				if err != nil {
-					tblIdx = slices.Index(r.ShardingSuffixs(), suffix)
-					if tblIdx == -1 {
-						return ftQuery, stQuery, tableName, errors.New("table suffix '" + suffix + "' is not in ShardingSuffixs. In order to generate the primary key, ShardingSuffixs should include all table suffixes")
-					}
-					//return ftQuery, stQuery, tableName, err
-				}
+		idx := slices.Index(suffixes, suffix)
+		if idx == -1 {
+			suffixes = append(suffixes, suffix)
+			suffixRows = append(suffixRows, nil)
+			idx = len(suffixes) - 1
+		}
+		suffixRows[idx] = append(suffixRows[idx], i)
 
-				id := r.PrimaryKeyGeneratorFn(int64(tblIdx))
-				if id == 0 {
-					fillID = false
-				}
+		if slices.ContainsFunc(insertNames, func(name *sqlparser.Ident) bool { return name.Name == r.primaryKey }) {
+			continue
+		}
+		var tblIdx int64
+		if tblIdx, err = r.suffixIndex(suffix); err != nil {
+			return
+		}
+		if id := r.PrimaryKeyGeneratorFn(tblIdx); id != 0 {
+			insertStmt.ColumnNames = append(insertNames, &sqlparser.Ident{Name: r.primaryKey})
+			insertExpression.Exprs = append(insertExpression.Exprs, &sqlparser.NumberLit{Value: strconv.FormatInt(id, 10)})
+		}
+	}
 
-				if fillID {
-					columnNames = append(insertNames, &sqlparser.Ident{Name: "id"})
-					insertValues = append(insertValues, &sqlparser.NumberLit{Value: strconv.FormatInt(id, 10)})
-				}
+	ftQuery = insertStmt.String()
+	if upsert != nil {
+		ftQuery = upsert.restore(ftQuery)
+	}
+	stQueries = make([]shardQuery, 0, len(suffixes))
+	for i, suffix := range suffixes {
+		rw := &rewriter{}
+		renameTables(rw, insertStmt, map[string]string{tableName: tableName + suffix})
+		stArgs := args
+		if len(suffixes) > 1 {
+			exprs := make([]*sqlparser.Exprs, 0, len(suffixRows[i]))
+			for _, row := range suffixRows[i] {
+				exprs = append(exprs, insertExpressions[row])
 			}
-
-			if fillID {
-				insertStmt.ColumnNames = columnNames
-				insertExpression.Exprs = insertValues
+			replace(rw, &insertStmt.Expressions, exprs)
+			stArgs = compactBinds(rw, insertStmt, args)
+			if upsert != nil {
+				stArgs = append(stArgs, upsert.updateArgs(args)...)
 			}
 		}
-
-		ftQuery = insertStmt.String()
-		insertStmt.TableName = newTable
-		stQuery = insertStmt.String()
-
-	} else {
-		var value any
-		var id int64
-		var keyFind bool
-		value, id, keyFind, err = s.nonInsertValue(r.ShardingKey, condition, args...)
-		if err != nil {
-			return
+		stQuery := insertStmt.String()
+		if upsert != nil {
+			stQuery = upsert.restore(stQuery)
 		}
 
-		suffix, err = getSuffix(value, id, keyFind, r)
-		if err != nil {
+		var source string
+		if source, err = dataSource(r, suffix); err != nil {
+			rw.restore()
 			return
 		}
+		stQueries = append(stQueries, shardQuery{source: source, suffix: suffix, query: stQuery, args: stArgs, rows: suffixRows[i]})
+		rw.restore()
+	}
 
-		newTable := &sqlparser.TableName{Name: &sqlparser.Ident{Name: tableName + suffix}}
+	return
+}
 
-		switch stmt := expr.(type) {
-		case *sqlparser.SelectStatement:
-			ftQuery = stmt.String()
-			//stmt.FromItems = newTable
-			//stmt.OrderBy = replaceOrderByTableName(stmt.OrderBy, tableName, newTable.Name.Name)
-			//stQuery = stmt.String()
-			stQuery = strings.ReplaceAll(stmt.String(), tableName, newTable.Name.Name)
-		case *sqlparser.UpdateStatement:
-			ftQuery = stmt.String()
-			//stmt.TableName = newTable
-			//stQuery = stmt.String()
-			stQuery = strings.ReplaceAll(stmt.String(), tableName, newTable.Name.Name)
-		case *sqlparser.DeleteStatement:
-			ftQuery = stmt.String()
-			//stmt.TableName = newTable
-			//stQuery = stmt.String()
-			stQuery = strings.ReplaceAll(stmt.String(), tableName, newTable.Name.Name)
+var (
+	dmlRegexp        = regexp.MustCompile(`(?i)^\s*(SELECT|INSERT|UPDATE|DELETE|REPLACE|WITH)\b`)
+	noShardingRegexp = regexp.MustCompile(`/\*\+?\s*nosharding\s*\*/`)
+)
+
+// unparsedShardingQuery returns whether a query which can't be parsed reads or
+// writes sharding tables, named after FROM, JOIN, INTO or UPDATE. It would be
+// executed on the table not sharded. The queries with clauses gorm builds but
+// the parser doesn't support, like FOR UPDATE, NOT (...), ILIKE and INTERVAL,
+// are executed as they are.
+func (s *Sharding) unparsedShardingQuery(query string) bool {
+	if !dmlRegexp.MatchString(query) || noShardingRegexp.MatchString(query) {
+		return false
+	}
+	var found, table bool
+	var prev sqlparser.Token
+	lexer := sqlparser.NewLexer(strings.NewReader(query))
+	for {
+		_, tok, lit := lexer.Lex()
+		switch {
+		case tok == sqlparser.EOF:
+			return found
+		case tok == sqlparser.MLCOMMENT:
+			continue
+		case prev == sqlparser.FOR && (tok == sqlparser.UPDATE || strings.EqualFold(lit, "SHARE")),
+			prev == sqlparser.NOT && tok == sqlparser.LP,
+			tok == sqlparser.IDENT && (strings.EqualFold(lit, "ILIKE") || strings.EqualFold(lit, "INTERVAL")):
+			return false
+		case tok == sqlparser.FROM, tok == sqlparser.JOIN, tok == sqlparser.INTO, tok == sqlparser.UPDATE:
+			table = true
+		case table && (tok == sqlparser.IDENT || tok == sqlparser.QIDENT):
+			// the name of a table, or its schema or alias
+			if _, ok := s.configs[strings.Trim(lit, "\"`")]; ok {
+				found = true
+			}
+		case table && (tok == sqlparser.DOT || tok == sqlparser.AS || tok == sqlparser.COMMA):
+		default:
+			table = false
 		}
+		prev = tok
 	}
+}
 
+// routeSuffixes returns the suffixes of the sharding tables a non-insert statement
+// touches, a SELECT goes to all sharding tables when fan out is enabled.
+func (s *Sharding) routeSuffixes(opts routeOptions, r Config, tableName string, qualifiers []string, condition sqlparser.Expr, isSelect bool, args ...any) (suffixes []string, keys []*keyCondition, err error) {
+	if opts.hint != nil {
+		suffixes, err = opts.hint.suffixes(r)
+		return
+	}
+	suffixes, keys, err = s.nonInsertSuffixes(r, qualifiers, condition, args...)
+	if isSelect && opts.fanOutEnabled(r) &&
+		(errors.Is(err, ErrMissingShardingKey) || errors.Is(err, errMissingPrimaryKeyAlgorithm)) {
+		suffixes = r.ShardingSuffixs()
+		if len(suffixes) == 0 {
+			return nil, nil, fmt.Errorf("sharding table:%s suffixs is empty", tableName)
+		}
+		err = nil
+	}
 	return
 }
 
@@ -464,7 +868,7 @@ func getSuffix(value any, id int64, keyFind bool, r Config) (suffix string, err
 		}
 	} else {
 		if r.ShardingAlgorithmByPrimaryKey == nil {
-			err = fmt.Errorf("there is not sharding key and ShardingAlgorithmByPrimaryKey is not configured")
+			err = errMissingPrimaryKeyAlgorithm
 			return
 		}
 		suffix = r.ShardingAlgorithmByPrimaryKey(id)
@@ -472,93 +876,36 @@ func getSuffix(value any, id int64, keyFind bool, r Config) (suffix string, err
 	return
 }
 
-func (s *Sharding) insertValue(key string, names []*sqlparser.Ident, exprs []sqlparser.Expr, args ...any) (value any, id int64, keyFind bool, err error) {
+// insertValue returns the value of the sharding key, a CompositeKey when there
+// are several key columns.
+func (s *Sharding) insertValue(keys []string, names []*sqlparser.Ident, exprs []sqlparser.Expr, args ...any) (value any, id int64, keyFind bool, err error) {
 	if len(names) != len(exprs) {
 		return nil, 0, keyFind, errors.New("column names and expressions mismatch")
 	}
 
-	for i, name := range names {
-		if name.Name == key {
-			switch expr := exprs[i].(type) {
-			case *sqlparser.BindExpr:
-				value = args[expr.Pos]
-			case *sqlparser.StringLit:
-				value = expr.Value
-			case *sqlparser.NumberLit:
-				value = expr.Value
-			default:
-				return nil, 0, keyFind, sqlparser.ErrNotImplemented
+	values := make(CompositeKey, 0, len(keys))
+	for _, key := range keys {
+		keyFind = false
+		for i, name := range names {
+			if name.Name == key {
+				if value, err = keyValue(exprs[i], args); err != nil {
+					return nil, 0, keyFind, err
+				}
+				keyFind = true
+				break
 			}
-			keyFind = true
-			break
 		}
-	}
-	if !keyFind {
-		return nil, 0, keyFind, ErrMissingShardingKey
-	}
-
-	return
-}
-
-func (s *Sharding) nonInsertValue(key string, condition sqlparser.Expr, args ...any) (value any, id int64, keyFind bool, err error) {
-	err = sqlparser.Walk(sqlparser.VisitFunc(func(node sqlparser.Node) error {
-		if n, ok := node.(*sqlparser.BinaryExpr); ok {
-			if x, ok := n.X.(*sqlparser.Ident); ok {
-				if x.Name == key && n.Op == sqlparser.EQ {
-					keyFind = true
-					switch expr := n.Y.(type) {
-					case *sqlparser.BindExpr:
-						value = args[expr.Pos]
-					case *sqlparser.StringLit:
-						value = expr.Value
-					case *sqlparser.NumberLit:
-						value = expr.Value
-					default:
-						return sqlparser.ErrNotImplemented
-					}
-					return nil
-				} else if x.Name == "id" && n.Op == sqlparser.EQ {
-					switch expr := n.Y.(type) {
-					case *sqlparser.BindExpr:
-						v := args[expr.Pos]
-						var ok bool
-						if id, ok = v.(int64); !ok {
-							return fmt.Errorf("ID should be int64 type")
-						}
-					case *sqlparser.NumberLit:
-						id, err = strconv.ParseInt(expr.Value, 10, 64)
-						if err != nil {
-							return err
-						}
-					default:
-						return ErrInvalidID
-					}
-					return nil
-				}
+		if !keyFind {
+			if len(keys) > 1 {
+				return nil, 0, keyFind, fmt.Errorf("%w: %s is missing", ErrMissingShardingKey, key)
 			}
+			return nil, 0, keyFind, ErrMissingShardingKey
 		}
-		return nil
-	}), condition)
-	if err != nil {
-		return
+		values = append(values, value)
 	}
 
-	if !keyFind && id == 0 {
-		return nil, 0, keyFind, ErrMissingShardingKey
+	if len(keys) > 1 {
+		value = values
 	}
-
 	return
 }
-
-func replaceOrderByTableName(orderBy []*sqlparser.OrderingTerm, oldName, newName string) []*sqlparser.OrderingTerm {
-	for i, term := range orderBy {
-		if x, ok := term.X.(*sqlparser.QualifiedRef); ok {
-			if x.Table.Name == oldName {
-				x.Table.Name = newName
-				orderBy[i].X = x
-			}
-		}
-	}
-
-	return orderBy
-}
@@ -2,6 +2,9 @@ package sharding
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
@@ -16,6 +19,7 @@ import (
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/hints"
 	"gorm.io/plugin/dbresolver"
 )
@@ -26,6 +30,13 @@ type Order struct {
 	Product string
 }
 
+type OrderItem struct {
+	ID      int64 `gorm:"primarykey"`
+	OrderID int64
+	UserID  int64
+	Name    string
+}
+
 type Category struct {
 	ID   int64 `gorm:"primarykey"`
 	Name string
@@ -197,6 +208,23 @@ func dropTables() {
 	}
 }
 
+// dialector opens the database of config with the dialect under test.
+func dialector(config postgres.Config) gorm.Dialector {
+	if mysqlDialector() {
+		return mysql.Open(config.DSN)
+	}
+	return postgres.New(config)
+}
+
+// openDB opens a new connection to the default test database, for the tests
+// that register their own sharding middleware.
+func openDB() *gorm.DB {
+	db, _ := gorm.Open(dialector(dbConfig), &gorm.Config{
+		DisableForeignKeyConstraintWhenMigrating: true,
+	})
+	return db
+}
+
 func TestMigrate(t *testing.T) {
 	targetTables := []string{"orders", "orders_0", "orders_1", "orders_2", "orders_3", "categories"}
 	sort.Strings(targetTables)
@@ -250,8 +278,20 @@ func TestInsertManyWithFillID(t *testing.T) {
 }
 
 func TestInsertDiffSuffix(t *testing.T) {
-	err := db.Create([]Order{{UserID: 100, Product: "Mac"}, {UserID: 101, Product: "Mac Pro"}}).Error
-	assert.Equal(t, ErrInsertDiffSuffix, err)
+	orders := []Order{{UserID: 100, Product: "Mac"}, {UserID: 101, Product: "Mac Pro"}, {UserID: 104, Product: "iMac"}}
+	err := db.Create(&orders).Error
+	assert.Equal[error](t, nil, err)
+
+	expected := `INSERT INTO orders_0 ("user_id", "product", id) VALUES ($1, $2, $sfid), ($3, $4, $sfid) RETURNING "id"; INSERT INTO orders_1 ("user_id", "product", id) VALUES ($1, $2, $sfid) RETURNING "id"`
+	assertSfidQueryResult(t, toDialect(expected), middleware.LastQuery())
+
+	if !mysqlDialector() {
+		for _, order := range orders {
+			var found Order
+			db.Model(&Order{}).Where("user_id", order.UserID).Where("id", order.ID).First(&found)
+			assert.Equal(t, order.Product, found.Product)
+		}
+	}
 }
 
 func TestSelect1(t *testing.T) {
@@ -327,6 +367,31 @@ func TestSelect14(t *testing.T) {
 	assert.Equal(t, toDialect(expected), middlewareNoID.LastQuery())
 }
 
+func TestSelectTableNameInLiteral(t *testing.T) {
+	tx := db.Model(&Order{}).Where("user_id = 101 AND product = 'orders'").Order("orders.id").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM orders_1 WHERE user_id = 101 AND product = 'orders' ORDER BY orders_1.id`, tx)
+}
+
+func TestSelectIn(t *testing.T) {
+	tx := db.Model(&Order{}).Where("user_id", []int64{100, 101, 104}).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM orders_0 WHERE "user_id" IN ($1, $2); SELECT * FROM orders_1 WHERE "user_id" IN ($1)`, tx)
+}
+
+func TestSelectInOneSuffix(t *testing.T) {
+	tx := db.Model(&Order{}).Where("user_id IN ?", []int64{100, 104}).Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM orders_0 WHERE user_id IN ($1, $2)`, tx)
+}
+
+func TestSelectAny(t *testing.T) {
+	if mysqlDialector() {
+		return
+	}
+
+	err := db.Model(&Order{}).Where("user_id = ANY(?)", int64Array{100, 101}).Find(&[]Order{}).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, `SELECT * FROM orders_0 WHERE user_id = ANY($1); SELECT * FROM orders_1 WHERE user_id = ANY($1)`, middleware.LastQuery())
+}
+
 func TestUpdate(t *testing.T) {
 	tx := db.Model(&Order{}).Where("user_id = ?", 100).Update("product", "new title")
 	assertQueryResult(t, `UPDATE orders_0 SET "product" = $1 WHERE user_id = $2`, tx)
@@ -337,6 +402,50 @@ func TestDelete(t *testing.T) {
 	assertQueryResult(t, `DELETE FROM orders_0 WHERE user_id = $1`, tx)
 }
 
+func TestDeleteIn(t *testing.T) {
+	tx := db.Where("user_id IN ?", []int64{101, 102}).Delete(&Order{})
+	assertQueryResult(t, `DELETE FROM orders_1 WHERE user_id IN ($1); DELETE FROM orders_2 WHERE user_id IN ($1)`, tx)
+}
+
+func TestUpsert(t *testing.T) {
+	onConflict := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"product"}),
+	}
+	tx := db.Clauses(onConflict).Create(&Order{ID: 200, UserID: 101, Product: "iPad"})
+	if mysqlDialector() {
+		assertQueryResult(t, "INSERT INTO orders_1 (`user_id`, `product`, `id`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `product`=VALUES(`product`)", tx)
+	} else {
+		assertQueryResult(t, `INSERT INTO orders_1 ("user_id", "product", "id") VALUES ($1, $2, $3) ON CONFLICT ("id") DO UPDATE SET "product" = "excluded"."product" RETURNING "id"`, tx)
+	}
+
+	// the row would be in a wrong sharding table
+	onConflict.DoUpdates = clause.Assignments(map[string]any{"user_id": 102})
+	err := db.Clauses(onConflict).Create(&Order{ID: 200, UserID: 101, Product: "iPad"}).Error
+	assert.Equal(t, ErrUpdateShardingKey, err)
+
+	if mysqlDialector() {
+		tx = db.Clauses(clause.Insert{Modifier: "IGNORE"}).Create(&Order{ID: 200, UserID: 101, Product: "iPad"})
+		assertQueryResult(t, "INSERT IGNORE INTO orders_1 (`user_id`, `product`, `id`) VALUES (?, ?, ?)", tx)
+
+		tx = db.Exec("REPLACE INTO orders (id, user_id, product) VALUES (?, ?, ?)", 200, 101, "iPad")
+		assertQueryResult(t, "REPLACE INTO orders_1 (id, user_id, product) VALUES (?, ?, ?)", tx)
+	}
+}
+
+func TestInsertSelect(t *testing.T) {
+	db.Create(&Order{UserID: 100, Product: "Vision Pro"})
+	err := db.Exec("INSERT INTO orders (user_id, product) SELECT user_id, product FROM orders WHERE user_id = ? AND product = ?", 100, "Vision Pro").Error
+	assert.Equal[error](t, nil, err)
+
+	expected := `SELECT user_id, product FROM orders_0 WHERE user_id = $1 AND product = $2; INSERT INTO orders_0 (user_id, product, id) VALUES ($1, $2, $sfid)`
+	assertSfidQueryResult(t, toDialect(expected), middleware.LastQuery())
+
+	var count int64
+	db.Model(&Order{}).Where("user_id", 100).Where("product", "Vision Pro").Count(&count)
+	assert.Equal(t, int64(2), count)
+}
+
 func TestInsertMissingShardingKey(t *testing.T) {
 	err := db.Exec(`INSERT INTO "orders" ("id", "product") VALUES(1, 'iPad')`).Error
 	assert.Equal(t, ErrMissingShardingKey, err)
@@ -347,6 +456,150 @@ func TestSelectMissingShardingKey(t *testing.T) {
 	assert.Equal(t, ErrMissingShardingKey, err)
 }
 
+func TestUnparsedQuery(t *testing.T) {
+	err := db.Exec(`SELECT * FROM "orders" WHERE "user_id" = 101::bigint`).Error
+	assert.Equal(t, true, errors.Is(err, ErrUnparsedQuery))
+
+	// FOR UPDATE isn't supported by the parser, it's executed as it is
+	err = db.Exec(`SELECT * FROM "orders" WHERE "user_id" = 101 FOR UPDATE`).Error
+	assert.Equal(t, false, errors.Is(err, ErrUnparsedQuery))
+}
+
+func TestRowMissingShardingKey(t *testing.T) {
+	err := db.Raw(`SELECT * FROM "orders" WHERE "product" = 'iPad'`).Row().Err()
+	assert.Equal(t, ErrMissingShardingKey, err)
+}
+
+func TestSelectFanOut(t *testing.T) {
+	tx := db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Where("product", "iPad").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM orders_0 WHERE "product" = $1; SELECT * FROM orders_1 WHERE "product" = $1; SELECT * FROM orders_2 WHERE "product" = $1; SELECT * FROM orders_3 WHERE "product" = $1`, tx)
+}
+
+func TestFanOutOrderLimit(t *testing.T) {
+	for _, userID := range []int64{100, 101, 102, 103, 104, 105} {
+		db.Create(&Order{UserID: userID, Product: "OrderLimit"})
+	}
+
+	var orders []Order
+	tx := db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Where("product", "OrderLimit").Order("user_id DESC").Limit(2).Offset(1).Find(&orders)
+	assertQueryResult(t, `SELECT * FROM orders_0 WHERE "product" = $1 ORDER BY user_id DESC LIMIT 3; SELECT * FROM orders_1 WHERE "product" = $1 ORDER BY user_id DESC LIMIT 3; SELECT * FROM orders_2 WHERE "product" = $1 ORDER BY user_id DESC LIMIT 3; SELECT * FROM orders_3 WHERE "product" = $1 ORDER BY user_id DESC LIMIT 3`, tx)
+	assert.Equal(t, 2, len(orders))
+	assert.Equal(t, int64(104), orders[0].UserID)
+	assert.Equal(t, int64(103), orders[1].UserID)
+
+	var order Order
+	tx = db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Where("product", "OrderLimit").First(&order)
+	assertQueryResult(t, `SELECT * FROM orders_0 WHERE "product" = $1 ORDER BY "orders_0"."id" LIMIT 1; SELECT * FROM orders_1 WHERE "product" = $1 ORDER BY "orders_1"."id" LIMIT 1; SELECT * FROM orders_2 WHERE "product" = $1 ORDER BY "orders_2"."id" LIMIT 1; SELECT * FROM orders_3 WHERE "product" = $1 ORDER BY "orders_3"."id" LIMIT 1`, tx)
+	assert.Equal(t, "OrderLimit", order.Product)
+
+	// sort key not in the projection
+	var userIDs []int64
+	db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Where("product", "OrderLimit").Order("id").Limit(3).Pluck("user_id", &userIDs)
+	assert.Equal(t, 3, len(userIDs))
+	assert.Equal(t, toDialect(`SELECT "user_id", id AS _sharding_1 FROM orders_0 WHERE "product" = $1 ORDER BY id LIMIT 3`), strings.Split(middleware.LastQuery(), "; ")[0])
+}
+
+func TestFanOutAggregate(t *testing.T) {
+	for _, userID := range []int64{100, 101, 102, 103, 105} {
+		db.Create(&Order{UserID: userID, Product: "Aggregate"})
+	}
+
+	var count int64
+	err := db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Where("product", "Aggregate").Count(&count).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(5), count)
+
+	var result struct {
+		Sum int64
+		Min int64
+		Max int64
+		Avg float64
+	}
+	err = db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Where("product", "Aggregate").
+		Select("SUM(user_id) AS sum, MIN(user_id) AS min, MAX(user_id) AS max, AVG(user_id) AS avg").Scan(&result).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(511), result.Sum)
+	assert.Equal(t, int64(100), result.Min)
+	assert.Equal(t, int64(105), result.Max)
+	assert.Equal(t, 102.2, result.Avg)
+	assert.Equal(t, toDialect(`SELECT SUM(user_id) AS sum, MIN(user_id) AS min, MAX(user_id) AS max, AVG(user_id) AS avg, SUM(user_id) AS _sharding_1, COUNT(user_id) AS _sharding_2 FROM orders_0 WHERE "product" = $1`), strings.Split(middleware.LastQuery(), "; ")[0])
+}
+
+func TestFanOutGroupBy(t *testing.T) {
+	for _, o := range []Order{{UserID: 100, Product: "GroupA"}, {UserID: 101, Product: "GroupA"}, {UserID: 102, Product: "GroupA"}, {UserID: 103, Product: "GroupB"}, {UserID: 100, Product: "GroupC"}, {UserID: 105, Product: "GroupC"}} {
+		db.Create(&o)
+	}
+
+	var results []struct {
+		Product string
+		Count   int64
+		Sum     int64
+	}
+	err := db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Select("product, COUNT(*) AS count, SUM(user_id) AS sum").
+		Where("product LIKE ?", "Group%").Group("product").Having("COUNT(*) > ?", 1).Order("product").Scan(&results).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "GroupA", results[0].Product)
+	assert.Equal(t, int64(3), results[0].Count)
+	assert.Equal(t, int64(303), results[0].Sum)
+	assert.Equal(t, "GroupC", results[1].Product)
+	assert.Equal(t, int64(2), results[1].Count)
+	assert.Equal(t, int64(205), results[1].Sum)
+	// HAVING is evaluated after the groups are merged
+	assert.Equal(t, toDialect(`SELECT product, COUNT(*) AS count, SUM(user_id) AS sum, COUNT(*) AS _sharding_1 FROM orders_0 WHERE product LIKE $1 GROUP BY product ORDER BY product`), strings.Split(middleware.LastQuery(), "; ")[0])
+}
+
+func TestFanOutDistinct(t *testing.T) {
+	for _, o := range []Order{{UserID: 100, Product: "DistinctA"}, {UserID: 101, Product: "DistinctA"}, {UserID: 100, Product: "DistinctB"}, {UserID: 104, Product: "DistinctB"}} {
+		db.Create(&o)
+	}
+
+	var products []string
+	err := db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Where("product LIKE ?", "Distinct%").Distinct("product").Order("product").Pluck("product", &products).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, []string{"DistinctA", "DistinctB"}, products)
+
+	var count int64
+	err = db.Set(ShardingFanOutStoreKey, true).Model(&Order{}).Where("product LIKE ?", "Distinct%").Distinct("user_id").Count(&count).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(3), count)
+	// the distinct values are collected from each sharding table
+	assert.Equal(t, toDialect(`SELECT COUNT(DISTINCT ("user_id")), ("user_id") AS _sharding_1 FROM orders_0 WHERE product LIKE $1 GROUP BY ("user_id")`), strings.Split(middleware.LastQuery(), "; ")[0])
+}
+
+func TestFanOutConfig(t *testing.T) {
+	db := openDB()
+	config := shardingConfig
+	config.FanOut = true
+	middleware := Register(config, &Order{})
+	db.Use(middleware)
+
+	db.Exec("INSERT INTO orders_2 (id, product, user_id) VALUES(2, 'FanOut', 102)")
+	db.Exec("INSERT INTO orders_3 (id, product, user_id) VALUES(3, 'FanOut', 103)")
+
+	var orders []Order
+	err := db.Model(&Order{}).Where("product", "FanOut").Find(&orders).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 2, len(orders))
+
+	err = db.Set(ShardingFanOutStoreKey, false).Model(&Order{}).Where("product", "FanOut").Find(&orders).Error
+	assert.Equal(t, ErrMissingShardingKey, err)
+}
+
+func TestHint(t *testing.T) {
+	tx := db.Clauses(Shard("_3")).Model(&Order{}).Where("product", "iPad").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM orders_3 WHERE "product" = $1`, tx)
+
+	tx = db.Clauses(ByKey(102)).Model(&Order{}).Where("product", "iPad").Find(&[]Order{})
+	assertQueryResult(t, `SELECT * FROM orders_2 WHERE "product" = $1`, tx)
+
+	tx = db.Clauses(AllShards()).Model(&Order{}).Where("product", "iPad").Update("product", "iPad Pro")
+	assertQueryResult(t, `UPDATE orders_0 SET "product" = $1 WHERE "product" = $2; UPDATE orders_1 SET "product" = $1 WHERE "product" = $2; UPDATE orders_2 SET "product" = $1 WHERE "product" = $2; UPDATE orders_3 SET "product" = $1 WHERE "product" = $2`, tx)
+
+	err := db.Clauses(Shard("_9")).Model(&Order{}).Where("product", "iPad").Find(&[]Order{}).Error
+	assert.Equal(t, true, errors.Is(err, ErrInvalidSuffix))
+}
+
 func TestSelectNoSharding(t *testing.T) {
 	sql := toDialect(`SELECT /* nosharding */ * FROM "orders" WHERE "product" = 'iPad'`)
 	err := db.Exec(sql).Error
@@ -368,6 +621,425 @@ func TestShardingKeyNotOK(t *testing.T) {
 	assert.Equal(t, ErrMissingShardingKey, err)
 }
 
+func TestSelectRange(t *testing.T) {
+	db := openDB()
+	config := shardingConfig
+	config.ShardingAlgorithm = func(value any) (string, error) {
+		userID, err := strconv.Atoi(fmt.Sprint(value))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("_%d", userID/100), nil
+	}
+	config.ShardingSuffixs = func() []string {
+		return []string{"_0", "_1", "_2", "_3"}
+	}
+	config.ShardingAlgorithmByRange = func(r Range) (suffixs []string, err error) {
+		lower, upper := 0, 399
+		if r.Min != nil {
+			lower, _ = strconv.Atoi(fmt.Sprint(r.Min))
+		}
+		if r.Max != nil {
+			upper, _ = strconv.Atoi(fmt.Sprint(r.Max))
+		}
+		for i := lower / 100; i <= upper/100 && i < 4; i++ {
+			suffixs = append(suffixs, fmt.Sprintf("_%d", i))
+		}
+		return
+	}
+	middleware := Register(config, &Order{})
+	db.Use(middleware)
+
+	db.Model(&Order{}).Where("user_id BETWEEN ? AND ?", 150, 250).Find(&[]Order{})
+	assert.Equal(t, toDialect(`SELECT * FROM orders_1 WHERE user_id BETWEEN $1 AND $2; SELECT * FROM orders_2 WHERE user_id BETWEEN $1 AND $2`), middleware.LastQuery())
+
+	db.Model(&Order{}).Where("user_id >= ? AND user_id < ?", 250, 300).Find(&[]Order{})
+	assert.Equal(t, toDialect(`SELECT * FROM orders_2 WHERE user_id >= $1 AND user_id < $2`), middleware.LastQuery())
+
+	db.Model(&Order{}).Where("user_id > 320 OR user_id = 10").Find(&[]Order{})
+	assert.Equal(t, toDialect(`SELECT * FROM orders_3 WHERE user_id > 320 OR user_id = 10; SELECT * FROM orders_0 WHERE user_id > 320 OR user_id = 10`), middleware.LastQuery())
+}
+
+func TestCompositeShardingKey(t *testing.T) {
+	db := openDB()
+	config := shardingConfig
+	config.ShardingKey = ""
+	config.ShardingKeys = []string{"user_id", "product"}
+	config.ShardingAlgorithm = func(value any) (string, error) {
+		key, ok := value.(CompositeKey)
+		if !ok {
+			return "", fmt.Errorf("invalid composite key %v", value)
+		}
+		userID, err := strconv.Atoi(fmt.Sprint(key[0]))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("_%d", (userID+len(fmt.Sprint(key[1])))%4), nil
+	}
+	config.ShardingSuffixs = func() []string {
+		return []string{"_0", "_1", "_2", "_3"}
+	}
+	middleware := Register(config, &Order{})
+	db.Use(middleware)
+
+	err := db.Create(&Order{UserID: 101, Product: "Composite"}).Error
+	assert.Equal[error](t, nil, err)
+	assert.Contains(t, middleware.LastQuery(), "INSERT INTO orders_2 ")
+
+	var orders []Order
+	err = db.Model(&Order{}).Where("user_id = ? AND product IN ?", 101, []string{"Composite", "Composite1"}).Find(&orders).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, toDialect(`SELECT * FROM orders_2 WHERE user_id = $1 AND product IN ($2, $3); SELECT * FROM orders_3 WHERE user_id = $1 AND product IN ($2, $3)`), middleware.LastQuery())
+
+	// every column of the sharding key is required
+	err = db.Model(&Order{}).Where("user_id", 101).Find(&orders).Error
+	assert.Equal(t, ErrMissingShardingKey, err)
+	err = db.Exec("INSERT INTO orders (user_id) VALUES (?)", 101).Error
+	assert.True(t, errors.Is(err, ErrMissingShardingKey))
+}
+
+func TestDataSources(t *testing.T) {
+	db := openDB()
+	config := shardingConfig
+	config.DataSources = map[string]gorm.Dialector{"read": dialector(dbReadConfig), "write": dialector(dbWriteConfig)}
+	config.DataSourceAlgorithm = func(suffix string) (string, error) {
+		if suffix == "_0" || suffix == "_1" {
+			return "read", nil
+		}
+		return "write", nil
+	}
+	config.FanOut = true
+	middleware := Register(config, &Order{})
+	db.Use(middleware)
+
+	err := db.Create([]Order{{UserID: 101, Product: "DataSource"}, {UserID: 102, Product: "DataSource"}}).Error
+	assert.Equal[error](t, nil, err)
+	var count int64
+	dbRead.Table("orders_1").Where("product", "DataSource").Count(&count)
+	assert.Equal(t, int64(1), count)
+	dbWrite.Table("orders_2").Where("product", "DataSource").Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	var orders []Order
+	err = db.Model(&Order{}).Where("user_id", 102).Find(&orders).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 1, len(orders))
+
+	err = db.Model(&Order{}).Where("product", "DataSource").Order("user_id").Find(&orders).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 2, len(orders))
+	assert.Equal(t, int64(101), orders[0].UserID)
+
+	// the transaction is on the default database
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&Order{UserID: 102, Product: "DataSource"}).Error
+	})
+	assert.Equal(t, ErrCrossDataSourceTx, err)
+}
+
+// skipNoPreparedTx skips the test when prepared transactions are disabled.
+func skipNoPreparedTx(t *testing.T, db *gorm.DB) {
+	if mysqlDialector() {
+		return
+	}
+	var maxPrepared int
+	db.Raw("SHOW max_prepared_transactions").Scan(&maxPrepared)
+	if maxPrepared == 0 {
+		t.Skip("max_prepared_transactions of PostgreSQL is 0")
+	}
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	db := openDB()
+	skipNoPreparedTx(t, db)
+	config := shardingConfig
+	config.DoubleWrite = false
+	config.MoveOnKeyUpdate = true
+	config.DataSources = map[string]gorm.Dialector{"read": dialector(dbReadConfig), "write": dialector(dbWriteConfig)}
+	config.DataSourceAlgorithm = func(suffix string) (string, error) {
+		if suffix == "_0" || suffix == "_1" {
+			return "read", nil
+		}
+		return "write", nil
+	}
+	log := NewFileTxLog(t.TempDir() + "/tx.log")
+	err := db.Use(Register(config, &Order{}).TwoPhaseCommit(log))
+	assert.Equal[error](t, nil, err)
+
+	count := func(db *gorm.DB, table string) (count int64) {
+		db.Table(table).Where("product", "TwoPhaseCommit").Count(&count)
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create([]Order{{UserID: 101, Product: "TwoPhaseCommit"}, {UserID: 102, Product: "TwoPhaseCommit"}}).Error
+	})
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(1), count(dbRead, "orders_1"))
+	assert.Equal(t, int64(1), count(dbWrite, "orders_2"))
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create([]Order{{UserID: 101, Product: "TwoPhaseCommit"}, {UserID: 102, Product: "TwoPhaseCommit"}}).Error; err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	assert.Equal(t, "rollback", err.Error())
+	assert.Equal(t, int64(1), count(dbRead, "orders_1"))
+	assert.Equal(t, int64(1), count(dbWrite, "orders_2"))
+
+	// the rows are moved across data sources
+	order := Order{UserID: 101, Product: "TwoPhaseCommit"}
+	db.Create(&order)
+	err = db.Model(&Order{}).Where("user_id", 101).Where("id", order.ID).Update("user_id", 102).Error
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(1), count(dbRead, "orders_1"))
+	assert.Equal(t, int64(2), count(dbWrite, "orders_2"))
+
+	// a transaction on one data source is a plain transaction
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&Order{UserID: 101, Product: "TwoPhaseCommit"}).Error; err != nil {
+			return err
+		}
+		dtx := tx.Statement.ConnPool.(*ConnPool).ConnPool.(*distributedTx)
+		assert.Equal(t, []string{"read"}, dtx.sources)
+		if !mysqlDialector() {
+			_, plain := dtx.branches["read"].ConnPool.(*sql.Tx)
+			assert.Equal(t, true, plain)
+		}
+		return nil
+	})
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(2), count(dbRead, "orders_1"))
+
+	// the log is truncated when all transactions in it are done
+	records, _ := log.Records()
+	assert.Equal(t, 0, len(records))
+}
+
+func TestRecover(t *testing.T) {
+	db := openDB()
+	skipNoPreparedTx(t, db)
+	ctx := context.Background()
+	// prepare leaves a branch of xid prepared on db, as a crash after PREPARE.
+	prepare := func(db *gorm.DB, xid, table string) {
+		sqlDB, _ := db.DB()
+		b, err := beginBranch(ctx, sqlDB, branchXID(xid, 0), dialectXA[db.Dialector.Name()], nil)
+		assert.Equal[error](t, nil, err)
+		defer b.close()
+		_, err = b.ExecContext(ctx, "INSERT INTO "+table+" (id, user_id, product) VALUES ("+strconv.FormatInt(node.Generate().Int64(), 10)+", 101, 'Recover')")
+		assert.Equal[error](t, nil, err)
+		assert.Equal[error](t, nil, b.prepare(ctx))
+		b.broken = true
+	}
+	prepare(dbRead, "gorm_sharding_recover_commit", "orders_1")
+	prepare(dbWrite, "gorm_sharding_recover_abort", "orders_2")
+
+	log := NewFileTxLog(t.TempDir() + "/tx.log")
+	assert.Equal[error](t, nil, log.Append(TxRecord{XID: "gorm_sharding_recover_commit", State: TxPreparing, Sources: []string{"read"}}))
+	assert.Equal[error](t, nil, log.Append(TxRecord{XID: "gorm_sharding_recover_commit", State: TxCommitting}))
+	assert.Equal[error](t, nil, log.Append(TxRecord{XID: "gorm_sharding_recover_abort", State: TxPreparing, Sources: []string{"write"}}))
+
+	config := shardingConfig
+	config.DataSources = map[string]gorm.Dialector{"read": dialector(dbReadConfig), "write": dialector(dbWriteConfig)}
+	config.DataSourceAlgorithm = func(suffix string) (string, error) {
+		if suffix == "_0" || suffix == "_1" {
+			return "read", nil
+		}
+		return "write", nil
+	}
+	// the branches in doubt are resolved when the plugin is initialized
+	err := db.Use(Register(config, &Order{}).TwoPhaseCommit(log))
+	assert.Equal[error](t, nil, err)
+
+	var count int64
+	dbRead.Table("orders_1").Where("product", "Recover").Count(&count)
+	assert.Equal(t, int64(1), count)
+	dbWrite.Table("orders_2").Where("product", "Recover").Count(&count)
+	assert.Equal(t, int64(0), count)
+	records, _ := log.Records()
+	assert.Equal(t, 0, len(records))
+}
+
+func TestSelectJoin(t *testing.T) {
+	db := openDB()
+	middleware := Register(shardingConfig, &Order{}, &OrderItem{}).Binding(&Order{}, &OrderItem{})
+	db.Use(middleware)
+
+	sql := toDialect(`SELECT "orders"."id", "i"."name" FROM "orders" JOIN "order_items" AS "i" ON "i"."order_id" = "orders"."id" AND "i"."user_id" = "orders"."user_id" WHERE "orders"."user_id" = $1`)
+	db.Raw(sql, 101).Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT "orders_1"."id", "i"."name" FROM orders_1 JOIN order_items_1 AS "i" ON "i"."order_id" = "orders_1"."id" AND "i"."user_id" = "orders_1"."user_id" WHERE "orders_1"."user_id" = $1`), middleware.LastQuery())
+
+	sql = toDialect(`SELECT "orders"."id", "i"."name" FROM "orders" JOIN "order_items" AS "i" ON "i"."order_id" = "orders"."id" WHERE "i"."user_id" IN ($1, $2)`)
+	db.Raw(sql, 101, 102).Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT "orders_1"."id", "i"."name" FROM orders_1 JOIN order_items_1 AS "i" ON "i"."order_id" = "orders_1"."id" WHERE "i"."user_id" IN ($1); SELECT "orders_2"."id", "i"."name" FROM orders_2 JOIN order_items_2 AS "i" ON "i"."order_id" = "orders_2"."id" WHERE "i"."user_id" IN ($1)`), middleware.LastQuery())
+}
+
+func TestJoinNotBinding(t *testing.T) {
+	db := openDB()
+	middleware := Register(shardingConfig, &Order{}, &OrderItem{})
+	db.Use(middleware)
+
+	sql := toDialect(`SELECT * FROM "orders" JOIN "order_items" ON "order_items"."order_id" = "orders"."id" WHERE "orders"."user_id" = $1`)
+	err := db.Raw(sql, 101).Scan(&[]map[string]any{}).Error
+	assert.Equal(t, ErrJoinNotBinding, err)
+}
+
+func TestSelectSubquery(t *testing.T) {
+	db := openDB()
+	middleware := Register(shardingConfig, &Order{}, &OrderItem{}).Binding(&Order{}, &OrderItem{})
+	db.Use(middleware)
+
+	// routed separately
+	sql := toDialect(`SELECT * FROM "orders" WHERE "user_id" = ? AND "id" IN (SELECT "order_id" FROM "order_items" WHERE "user_id" = ?)`)
+	db.Raw(sql, 101, 102).Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT * FROM orders_1 WHERE "user_id" = $1 AND "id" IN (SELECT "order_id" FROM order_items_2 WHERE "user_id" = $2)`), middleware.LastQuery())
+
+	sql = toDialect(`SELECT * FROM "orders" WHERE "user_id" = ? AND EXISTS (SELECT 1 FROM "order_items" WHERE "order_items"."order_id" = "orders"."id" AND "order_items"."user_id" = ?)`)
+	db.Raw(sql, 101, 102).Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT * FROM orders_1 WHERE "user_id" = $1 AND EXISTS (SELECT 1 FROM order_items_2 WHERE "order_items_2"."order_id" = "orders_1"."id" AND "order_items_2"."user_id" = $2)`), middleware.LastQuery())
+
+	// inherit the suffix of binding table
+	sql = toDialect(`SELECT * FROM "orders" WHERE "user_id" = ? AND EXISTS (SELECT 1 FROM "order_items" WHERE "order_items"."order_id" = "orders"."id" AND "order_items"."user_id" = "orders"."user_id")`)
+	db.Raw(sql, 101).Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT * FROM orders_1 WHERE "user_id" = $1 AND EXISTS (SELECT 1 FROM order_items_1 WHERE "order_items_1"."order_id" = "orders_1"."id" AND "order_items_1"."user_id" = "orders_1"."user_id")`), middleware.LastQuery())
+
+	// derived table
+	sql = toDialect(`SELECT COUNT(*) FROM (SELECT * FROM "orders" WHERE "user_id" = ?) AS "t"`)
+	db.Raw(sql, 101).Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT COUNT(*) FROM (SELECT * FROM orders_1 WHERE "user_id" = $1) AS "t"`), middleware.LastQuery())
+
+	sql = toDialect(`SELECT COUNT(*) FROM (SELECT * FROM "orders" WHERE "product" = ?) AS "t"`)
+	err := db.Raw(sql, "iPhone").Scan(&[]map[string]any{}).Error
+	assert.Equal(t, ErrMissingShardingKey, err)
+
+	db.Set(ShardingFanOutStoreKey, true).Raw(sql, "iPhone").Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT COUNT(*) FROM (SELECT * FROM (SELECT * FROM orders_0 UNION ALL SELECT * FROM orders_1 UNION ALL SELECT * FROM orders_2 UNION ALL SELECT * FROM orders_3) AS "orders" WHERE "product" = $1) AS "t"`), middleware.LastQuery())
+}
+
+func TestBroadcast(t *testing.T) {
+	db := openDB()
+	middleware := Register(shardingConfig, &Order{}).Broadcast(&Category{})
+	db.Use(middleware)
+
+	err := db.Create(&Category{ID: 100, Name: "Broadcast"}).Error
+	assert.Equal[error](t, nil, err)
+	db.Delete(&Category{ID: 100})
+
+	sql := toDialect(`SELECT "orders"."id", "categories"."name" FROM "orders" JOIN "categories" ON "categories"."id" = "orders"."id" WHERE "orders"."user_id" = $1`)
+	db.Raw(sql, 101).Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT "orders_1"."id", "categories"."name" FROM orders_1 JOIN "categories" ON "categories"."id" = "orders_1"."id" WHERE "orders_1"."user_id" = $1`), middleware.LastQuery())
+
+	// the sharding table in subquery is routed
+	sql = toDialect(`SELECT * FROM "categories" WHERE EXISTS (SELECT 1 FROM "orders" WHERE "orders"."id" = "categories"."id" AND "orders"."user_id" = ?)`)
+	db.Raw(sql, 101).Scan(&[]map[string]any{})
+	assert.Equal(t, toDialect(`SELECT * FROM "categories" WHERE EXISTS (SELECT 1 FROM orders_1 WHERE "orders_1"."id" = "categories"."id" AND "orders_1"."user_id" = $1)`), middleware.LastQuery())
+
+	sql = toDialect(`DELETE FROM "categories" WHERE EXISTS (SELECT 1 FROM "orders" WHERE "orders"."id" = "categories"."id" AND "orders"."user_id" = ?)`)
+	err = db.Exec(sql, 101).Error
+	assert.Equal(t, true, errors.Is(err, ErrCrossDataSource))
+
+	s := Register(shardingConfig, &Order{}).Broadcast(&Order{})
+	s.DB = db
+	err = s.compile()
+	assert.Equal(t, "broadcast table orders can not be a sharding table", err.Error())
+}
+
+func TestBroadcastTx(t *testing.T) {
+	db := openDB()
+	config := shardingConfig
+	config.DataSources = map[string]gorm.Dialector{"read": dialector(dbReadConfig), "write": dialector(dbWriteConfig)}
+	config.DataSourceAlgorithm = func(suffix string) (string, error) {
+		if suffix == "_0" || suffix == "_1" {
+			return "read", nil
+		}
+		return "write", nil
+	}
+	err := db.Use(Register(config, &Order{}).Broadcast(&Category{}))
+	assert.Equal[error](t, nil, err)
+
+	// a transaction without two-phase commit can't write the other data sources
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&Category{ID: 101, Name: "BroadcastTx"}).Error
+	})
+	assert.Equal(t, true, errors.Is(err, ErrCrossDataSourceTx))
+	// nothing is written, even on the database of the transaction
+	var count int64
+	db.Set(ShardingIgnoreStoreKey, nil).Table("categories").Where("name", "BroadcastTx").Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestRegisterRules(t *testing.T) {
+	db := openDB()
+	itemConfig := Config{
+		ShardingKey:         "order_id",
+		NumberOfShards:      2,
+		PrimaryKeyGenerator: PKSnowflake,
+	}
+	middleware := Register(shardingConfig, &Order{}).Register(itemConfig, &OrderItem{})
+	err := db.Use(middleware)
+	assert.Equal[error](t, nil, err)
+
+	db.Model(&Order{}).Where("user_id", 101).Find(&[]Order{})
+	assert.Equal(t, toDialect(`SELECT * FROM orders_1 WHERE "user_id" = $1`), middleware.LastQuery())
+
+	db.Model(&OrderItem{}).Where("order_id", 101).Find(&[]OrderItem{})
+	assert.Equal(t, toDialect(`SELECT * FROM order_items_1 WHERE "order_id" = $1`), middleware.LastQuery())
+
+	err = db.Model(&OrderItem{}).Where("user_id", 101).Find(&[]OrderItem{}).Error
+	assert.Equal(t, ErrMissingShardingKey, err)
+
+	// a table can be in only one rule set
+	err = Register(shardingConfig, "orders").Register(itemConfig, "orders").compile()
+	assert.NotEqual[error](t, nil, err)
+}
+
+func TestUpdateShardingKey(t *testing.T) {
+	err := db.Model(&Order{}).Where("user_id", 100).Update("user_id", 101).Error
+	assert.Equal(t, ErrUpdateShardingKey, err)
+
+	// the rows stay in the same sharding table
+	tx := db.Model(&Order{}).Where("user_id", 104).Update("user_id", 108)
+	assertQueryResult(t, `UPDATE orders_0 SET "user_id" = $1 WHERE "user_id" = $2`, tx)
+
+	db := openDB()
+	config := shardingConfig
+	config.MoveOnKeyUpdate = true
+	err = db.Use(Register(config, &Order{}))
+	assert.Equal[error](t, nil, err)
+
+	order := Order{UserID: 102, Product: "iPad"}
+	db.Create(&order)
+	err = db.Model(&Order{}).Where("user_id", 102).Where("id", order.ID).Update("user_id", 103).Error
+	assert.Equal[error](t, nil, err)
+
+	var count int64
+	db.Model(&Order{}).Where("user_id", 102).Where("id", order.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+	var moved Order
+	db.Model(&Order{}).Where("user_id", 103).Where("id", order.ID).First(&moved)
+	assert.Equal(t, "iPad", moved.Product)
+
+	// the rows can't be moved to another data source without two-phase commit
+	config.DataSources = map[string]gorm.Dialector{"read": dialector(dbReadConfig), "write": dialector(dbWriteConfig)}
+	config.DataSourceAlgorithm = func(suffix string) (string, error) {
+		if suffix == "_0" || suffix == "_1" {
+			return "read", nil
+		}
+		return "write", nil
+	}
+	db = openDB()
+	err = db.Use(Register(config, &Order{}))
+	assert.Equal[error](t, nil, err)
+
+	order = Order{UserID: 101, Product: "iPad"}
+	db.Create(&order)
+	err = db.Model(&Order{}).Where("user_id", 101).Where("id", order.ID).Update("user_id", 102).Error
+	assert.Equal(t, true, errors.Is(err, ErrCrossDataSource))
+	db.Model(&Order{}).Where("user_id", 101).Where("id", order.ID).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
 func TestShardingIdOK(t *testing.T) {
 	err := db.Model(&Order{}).Where("id = ? and user_id > ?", int64(101), 100).Find(&[]Order{}).Error
 	assert.Equal[error](t, nil, err)
@@ -505,6 +1177,17 @@ func TestDataRace(t *testing.T) {
 	}
 }
 
+// int64Array is a PostgreSQL bigint[] argument.
+type int64Array []int64
+
+func (a int64Array) Value() (driver.Value, error) {
+	elems := make([]string, 0, len(a))
+	for _, v := range a {
+		elems = append(elems, strconv.FormatInt(v, 10))
+	}
+	return "{" + strings.Join(elems, ",") + "}", nil
+}
+
 func assertQueryResult(t *testing.T, expected string, tx *gorm.DB) {
 	t.Helper()
 	assert.Equal(t, toDialect(expected), middleware.LastQuery())
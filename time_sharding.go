@@ -0,0 +1,183 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TimeGranularity is the time period of each sharding table.
+type TimeGranularity int
+
+const (
+	// Daily tables like orders_20261016.
+	Daily TimeGranularity = iota + 1
+	// Weekly tables of ISO week like orders_2026_w42.
+	Weekly
+	// Monthly tables like orders_202610.
+	Monthly
+	// Yearly tables like orders_2026.
+	Yearly
+)
+
+// TimeSharding is the built-in algorithm to shard a table by a time column,
+// every table has the rows of one day, week, month or year. The sharding key
+// can be time.Time, unix timestamp in seconds, or string like "2006-01-02 15:04:05"
+// or "20060102". The snowflake node of the primary key is the position of the
+// suffix in ShardingSuffixs.
+//
+//	sharding.Config{
+//		ShardingKey: "created_at",
+//		TimeSharding: &sharding.TimeSharding{
+//			Granularity: sharding.Monthly,
+//			Start:       time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+//			End:         time.Date(2027, 12, 31, 0, 0, 0, 0, time.UTC),
+//		},
+//	}
+type TimeSharding struct {
+	Granularity TimeGranularity
+	// Location is the timezone the periods are in, defaults to UTC.
+	Location *time.Location
+	// Start and End is the time window of the sharding tables, ShardingSuffixs
+	// returns the tables from the period of Start to the period of End, and
+	// the time out of the window can not be routed.
+	Start time.Time
+	End   time.Time
+}
+
+func (ts *TimeSharding) compile() error {
+	if ts.Granularity < Daily || ts.Granularity > Yearly {
+		return errors.New("TimeSharding Granularity should be one of Daily, Weekly, Monthly and Yearly")
+	}
+	if ts.Start.IsZero() || ts.End.IsZero() || ts.End.Before(ts.Start) {
+		return errors.New("TimeSharding Start and End are required, and End should not be before Start")
+	}
+	if ts.Location == nil {
+		ts.Location = time.UTC
+	}
+	return nil
+}
+
+// ShardingAlgorithm returns the suffix of the period of value.
+func (ts *TimeSharding) ShardingAlgorithm(value any) (suffix string, err error) {
+	t, err := ts.toTime(value)
+	if err != nil {
+		return "", err
+	}
+	if t.Before(ts.truncate(ts.Start)) || !t.Before(ts.next(ts.truncate(ts.End))) {
+		return "", fmt.Errorf("%s is out of the time window of sharding tables", t.Format(time.RFC3339))
+	}
+	return ts.suffix(t), nil
+}
+
+// ShardingSuffixs returns the suffixes of all periods from Start to End.
+func (ts *TimeSharding) ShardingSuffixs() (suffixs []string) {
+	return ts.suffixes(ts.Start, ts.End)
+}
+
+// ShardingAlgorithmByRange returns the suffixes of the periods overlapped with r.
+func (ts *TimeSharding) ShardingAlgorithmByRange(r Range) (suffixs []string, err error) {
+	start, end := ts.Start, ts.End
+	if r.Min != nil {
+		min, err := ts.toTime(r.Min)
+		if err != nil {
+			return nil, err
+		}
+		if min.After(start) {
+			start = min
+		}
+	}
+	if r.Max != nil {
+		max, err := ts.toTime(r.Max)
+		if err != nil {
+			return nil, err
+		}
+		if max.Before(end) {
+			end = max
+		}
+	}
+	return ts.suffixes(start, end), nil
+}
+
+func (ts *TimeSharding) suffixes(start, end time.Time) (suffixs []string) {
+	end = ts.truncate(end)
+	for t := ts.truncate(start); !t.After(end); t = ts.next(t) {
+		suffixs = append(suffixs, ts.suffix(t))
+	}
+	return
+}
+
+func (ts *TimeSharding) suffix(t time.Time) string {
+	t = t.In(ts.Location)
+	switch ts.Granularity {
+	case Daily:
+		return t.Format("_20060102")
+	case Weekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("_%04d_w%02d", year, week)
+	case Monthly:
+		return t.Format("_200601")
+	default:
+		return t.Format("_2006")
+	}
+}
+
+// truncate returns the start of the period of t.
+func (ts *TimeSharding) truncate(t time.Time) time.Time {
+	t = t.In(ts.Location)
+	year, month, day := t.Date()
+	switch ts.Granularity {
+	case Daily:
+		return time.Date(year, month, day, 0, 0, 0, 0, ts.Location)
+	case Weekly:
+		// ISO weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-offset, 0, 0, 0, 0, ts.Location)
+	case Monthly:
+		return time.Date(year, month, 1, 0, 0, 0, 0, ts.Location)
+	default:
+		return time.Date(year, 1, 1, 0, 0, 0, 0, ts.Location)
+	}
+}
+
+// next returns the start of the next period of a period start.
+func (ts *TimeSharding) next(t time.Time) time.Time {
+	switch ts.Granularity {
+	case Daily:
+		return t.AddDate(0, 0, 1)
+	case Weekly:
+		return t.AddDate(0, 0, 7)
+	case Monthly:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(1, 0, 0)
+	}
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02 15:04:05", "2006-01-02", "20060102150405", "20060102"}
+
+func (ts *TimeSharding) toTime(value any) (time.Time, error) {
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	// a string like "20261016" is a date rather than unix timestamp
+	if v, ok := value.(string); ok {
+		for _, layout := range timeLayouts {
+			if t, err := time.ParseInLocation(layout, v, ts.Location); err == nil {
+				return t, nil
+			}
+		}
+	}
+
+	value, err := normalizeKey(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, ok := value.(time.Time); ok {
+		return t, nil
+	}
+	if sec, ok := toInt(value); ok {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %v of TimeSharding", value)
+}
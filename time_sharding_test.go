@@ -0,0 +1,74 @@
+package sharding
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/longbridgeapp/assert"
+)
+
+func TestTimeSharding(t *testing.T) {
+	ts := &TimeSharding{
+		Granularity: Monthly,
+		Start:       time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+		End:         time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	assert.Equal[error](t, nil, ts.compile())
+	assert.Equal(t, []string{"_202610", "_202611", "_202612", "_202701"}, ts.ShardingSuffixs())
+
+	suffix, err := ts.ShardingAlgorithm(time.Date(2026, 11, 30, 23, 0, 0, 0, time.UTC))
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "_202611", suffix)
+	suffix, _ = ts.ShardingAlgorithm("2026-12-01 08:00:00")
+	assert.Equal(t, "_202612", suffix)
+	suffix, _ = ts.ShardingAlgorithm("20261016")
+	assert.Equal(t, "_202610", suffix)
+	suffix, _ = ts.ShardingAlgorithm(int64(1791763200)) // 2026-10-12 UTC
+	assert.Equal(t, "_202610", suffix)
+	_, err = ts.ShardingAlgorithm(time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC))
+	assert.NotEqual[error](t, nil, err)
+
+	suffixs, err := ts.ShardingAlgorithmByRange(Range{Min: "2026-11-15", MinInclusive: true})
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, []string{"_202611", "_202612", "_202701"}, suffixs)
+
+	// the periods are in Location
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	ts = &TimeSharding{Granularity: Daily, Location: shanghai, Start: time.Date(2026, 10, 1, 0, 0, 0, 0, shanghai), End: time.Date(2026, 10, 31, 0, 0, 0, 0, shanghai)}
+	assert.Equal[error](t, nil, ts.compile())
+	suffix, _ = ts.ShardingAlgorithm(time.Date(2026, 10, 15, 20, 0, 0, 0, time.UTC))
+	assert.Equal(t, "_20261016", suffix)
+
+	ts = &TimeSharding{Granularity: Weekly, Start: time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), End: time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)}
+	assert.Equal[error](t, nil, ts.compile())
+	assert.Equal(t, []string{"_2026_w42", "_2026_w43"}, ts.ShardingSuffixs())
+}
+
+func TestTimeShardingPrimaryKey(t *testing.T) {
+	s := Register(Config{
+		ShardingKey:         "created_at",
+		TimeSharding:        &TimeSharding{Granularity: Monthly, Start: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		PrimaryKeyGenerator: PKSnowflake,
+	}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+
+	// the node is the position of the suffix in ShardingSuffixs
+	r := s.configs["orders"]
+	index, err := r.suffixIndex("_202611")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, int64(1), index)
+	_, err = r.suffixIndex("_209901")
+	assert.NotEqual[error](t, nil, err)
+
+	node, _ := snowflake.NewNode(index)
+	assert.Equal(t, "_202611", r.ShardingAlgorithmByPrimaryKey(node.Generate().Int64()))
+
+	// more tables than snowflake nodes
+	s = Register(Config{
+		ShardingKey:         "created_at",
+		TimeSharding:        &TimeSharding{Granularity: Daily, Start: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+		PrimaryKeyGenerator: PKSnowflake,
+	}, "orders")
+	assert.NotEqual[error](t, nil, s.compile())
+}
@@ -0,0 +1,499 @@
+package sharding
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// TwoPhaseCommit enables two-phase commit for the transactions of gorm DB, so
+// a transaction can span several data sources. The statements are executed in
+// a branch of the transaction on each data source, XA of MySQL or `PREPARE
+// TRANSACTION` of PostgreSQL, and the branches are prepared and committed by
+// log, which the branches in doubt are resolved by after a crash. It takes
+// effect only when Config.DataSources are configured, a transaction on one
+// data source is committed in one phase.
+//
+//	db.Use(sharding.Register(config, &Order{}).TwoPhaseCommit(sharding.NewFileTxLog("sharding_tx.log")))
+func (s *Sharding) TwoPhaseCommit(log TxLog) *Sharding {
+	s.txLog = log
+	return s
+}
+
+// txPool is the ConnPool of gorm DB when two-phase commit is enabled, it begins
+// the transactions by ConnPool.BeginTx. The statements are executed by the
+// ConnPool switched in callbacks.
+type txPool struct {
+	gorm.ConnPool
+	sharding *Sharding
+}
+
+// distributed returns whether transactions span data sources by two-phase
+// commit, it's enabled and there are data sources other than gorm DB.
+func (s *Sharding) distributed() bool {
+	return s.txLog != nil && len(s.sources) > 0
+}
+
+func (pool *txPool) BeginTx(ctx context.Context, opt *sql.TxOptions) (gorm.ConnPool, error) {
+	return (&ConnPool{ConnPool: pool.ConnPool, sharding: pool.sharding}).BeginTx(ctx, opt)
+}
+
+// GetDBConn implements gorm.GetDBConnector, for gorm DB.DB().
+func (pool *txPool) GetDBConn() (*sql.DB, error) {
+	if connector, ok := pool.ConnPool.(gorm.GetDBConnector); ok {
+		return connector.GetDBConn()
+	}
+	if db, ok := pool.ConnPool.(*sql.DB); ok {
+		return db, nil
+	}
+	return nil, gorm.ErrInvalidDB
+}
+
+// xaStatements are the statements of a transaction branch of a dialect, `{xid}`
+// is replaced by the xid of the branch, and `{isolation}` by the statement to
+// set the isolation level, it's skipped when not specified. A branch of the
+// dialect without begin is a plain transaction until it's prepared.
+type xaStatements struct {
+	begin            []string
+	prepare          []string
+	commitOnePhase   []string
+	rollback         []string
+	commitPrepared   string
+	rollbackPrepared string
+	// recover returns the xids of the prepared branches in its last column.
+	recover string
+}
+
+var dialectXA = map[string]xaStatements{
+	"mysql": {
+		begin:            []string{"{isolation}", "XA START '{xid}'"},
+		prepare:          []string{"XA END '{xid}'", "XA PREPARE '{xid}'"},
+		commitOnePhase:   []string{"XA END '{xid}'", "XA COMMIT '{xid}' ONE PHASE"},
+		rollback:         []string{"XA END '{xid}'", "XA ROLLBACK '{xid}'"},
+		commitPrepared:   "XA COMMIT '{xid}'",
+		rollbackPrepared: "XA ROLLBACK '{xid}'",
+		recover:          "XA RECOVER",
+	},
+	"postgres": {
+		prepare:          []string{"PREPARE TRANSACTION '{xid}'"},
+		commitPrepared:   "COMMIT PREPARED '{xid}'",
+		rollbackPrepared: "ROLLBACK PREPARED '{xid}'",
+		recover:          "SELECT gid FROM pg_prepared_xacts WHERE database = current_database()",
+	},
+}
+
+// sourceXA returns the statements of the dialect of a data source.
+func (s *Sharding) sourceXA(source string) (xaStatements, error) {
+	name := s.sourceDB(source).Dialector.Name()
+	xa, ok := dialectXA[name]
+	if !ok {
+		return xa, fmt.Errorf("two-phase commit is not supported by %s", name)
+	}
+	return xa, nil
+}
+
+// isolation returns the statement to set the isolation level of an XA branch.
+func isolation(opt *sql.TxOptions) (string, error) {
+	if opt == nil || opt.Isolation == sql.LevelDefault && !opt.ReadOnly {
+		return "", nil
+	}
+	var modes []string
+	switch opt.Isolation {
+	case sql.LevelDefault:
+	case sql.LevelReadUncommitted, sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable:
+		modes = append(modes, "ISOLATION LEVEL "+strings.ToUpper(opt.Isolation.String()))
+	default:
+		return "", fmt.Errorf("isolation level %s is not supported by two-phase commit", opt.Isolation)
+	}
+	if opt.ReadOnly {
+		modes = append(modes, "READ ONLY")
+	}
+	return "SET TRANSACTION " + strings.Join(modes, ", "), nil
+}
+
+// branchXID returns the xid of the branch of the i-th data source of xid.
+func branchXID(xid string, i int) string {
+	return xid + "_" + strconv.Itoa(i)
+}
+
+// txBranch is the branch of a distributed transaction on one data source. It's
+// a plain transaction, or the connection of an XA branch on MySQL, which XA is
+// begun on by its statements, as a transaction begun otherwise can't be prepared.
+type txBranch struct {
+	gorm.ConnPool
+	db  *sql.DB
+	xid string
+	xa  xaStatements
+	// broken, the connection is discarded when the branch is closed, so the
+	// branch not prepared is rolled back by the database.
+	broken bool
+}
+
+// beginBranch begins the branch of xid on db.
+func beginBranch(ctx context.Context, db *sql.DB, xid string, xa xaStatements, opt *sql.TxOptions) (*txBranch, error) {
+	b := &txBranch{db: db, xid: xid, xa: xa}
+	if len(xa.begin) == 0 {
+		tx, err := db.BeginTx(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		b.ConnPool = tx
+		return b, nil
+	}
+
+	level, err := isolation(opt)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.ConnPool = conn
+	var statements []string
+	for _, statement := range xa.begin {
+		if statement == "{isolation}" {
+			statement = level
+		}
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	if err := b.exec(ctx, statements...); err != nil {
+		b.close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *txBranch) exec(ctx context.Context, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := b.ExecContext(ctx, strings.ReplaceAll(statement, "{xid}", b.xid)); err != nil {
+			b.broken = true
+			return err
+		}
+	}
+	return nil
+}
+
+// commit commits the branch not prepared in one phase.
+func (b *txBranch) commit(ctx context.Context) error {
+	if tx, ok := b.ConnPool.(*sql.Tx); ok {
+		return tx.Commit()
+	}
+	return b.exec(ctx, b.xa.commitOnePhase...)
+}
+
+// rollback rolls back the branch not prepared, the branch which fails to roll
+// back is broken, and rolled back by the database when closed.
+func (b *txBranch) rollback(ctx context.Context) {
+	if tx, ok := b.ConnPool.(*sql.Tx); ok {
+		_ = tx.Rollback()
+		return
+	}
+	_ = b.exec(ctx, b.xa.rollback...)
+}
+
+// prepare prepares the branch. The transaction is ended by the database when
+// it's prepared, so a plain transaction returns its connection, and the
+// branch is committed or rolled back on any connection of db.
+func (b *txBranch) prepare(ctx context.Context) error {
+	if err := b.exec(ctx, b.xa.prepare...); err != nil {
+		return err
+	}
+	if tx, ok := b.ConnPool.(*sql.Tx); ok {
+		_ = tx.Rollback()
+		b.ConnPool = b.db
+	}
+	return nil
+}
+
+// close returns the connection to its pool, or discards it when broken.
+func (b *txBranch) close() {
+	switch conn := b.ConnPool.(type) {
+	case *sql.Tx:
+		_ = conn.Rollback()
+	case *sql.Conn:
+		if b.broken {
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}
+}
+
+// distributedTx is a transaction across data sources, a branch is begun on a
+// data source when a statement is executed on it first. It's committed by one
+// phase when there is only one branch, or by two-phase commit.
+type distributedTx struct {
+	sharding *Sharding
+	ctx      context.Context
+	opt      *sql.TxOptions
+	xid      string
+
+	sources  []string
+	branches map[string]*txBranch
+	mutex    sync.Mutex
+}
+
+func (s *Sharding) beginDistributedTx(ctx context.Context, opt *sql.TxOptions) (*distributedTx, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &distributedTx{
+		sharding: s,
+		ctx:      ctx,
+		opt:      opt,
+		xid:      "gorm_sharding_" + hex.EncodeToString(id),
+		branches: make(map[string]*txBranch),
+	}, nil
+}
+
+// branch returns the branch on a data source, it's begun when not yet.
+func (tx *distributedTx) branch(source string) (*txBranch, error) {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	if b, ok := tx.branches[source]; ok {
+		return b, nil
+	}
+
+	xa, err := tx.sharding.sourceXA(source)
+	if err != nil {
+		return nil, err
+	}
+	db, err := tx.sharding.sourceDB(source).DB()
+	if err != nil {
+		return nil, err
+	}
+	b, err := beginBranch(tx.ctx, db, branchXID(tx.xid, len(tx.sources)), xa, tx.opt)
+	if err != nil {
+		return nil, err
+	}
+	tx.sources = append(tx.sources, source)
+	tx.branches[source] = b
+	return b, nil
+}
+
+// The statements not routed by sharding, like SAVEPOINT, are executed on the
+// branch of the database of gorm DB.
+
+func (tx *distributedTx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	b, err := tx.branch("")
+	if err != nil {
+		return nil, err
+	}
+	return b.PrepareContext(ctx, query)
+}
+
+func (tx *distributedTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	b, err := tx.branch("")
+	if err != nil {
+		return nil, err
+	}
+	return b.ExecContext(ctx, query, args...)
+}
+
+func (tx *distributedTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	b, err := tx.branch("")
+	if err != nil {
+		return nil, err
+	}
+	return b.QueryContext(ctx, query, args...)
+}
+
+func (tx *distributedTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	b, err := tx.branch("")
+	if err != nil {
+		return toRow(ctx, nil, err)
+	}
+	return b.QueryRowContext(ctx, query, args...)
+}
+
+// Commit commits the transaction by two-phase commit. The branches are prepared
+// after TxPreparing is logged, and committed after TxCommitting is logged, so a
+// crash in any phase can be recovered by the log.
+func (tx *distributedTx) Commit() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	defer tx.close()
+
+	ctx := tx.ctx
+	switch len(tx.sources) {
+	case 0:
+		return nil
+	case 1:
+		return tx.branches[tx.sources[0]].commit(ctx)
+	}
+
+	err := tx.commitTwoPhase(ctx)
+	tx.sharding.compactTxLog()
+	return err
+}
+
+func (tx *distributedTx) commitTwoPhase(ctx context.Context) error {
+	// Recover and compactTxLog don't run until the transaction is done
+	tx.sharding.txMutex.RLock()
+	defer tx.sharding.txMutex.RUnlock()
+	log := tx.sharding.txLog
+	if err := log.Append(TxRecord{XID: tx.xid, State: TxPreparing, Sources: tx.sources}); err != nil {
+		tx.rollback(tx.sources...)
+		return err
+	}
+
+	for i, source := range tx.sources {
+		if err := tx.branches[source].prepare(ctx); err != nil {
+			tx.rollback(tx.sources[i+1:]...)
+			if rollbackErr := tx.rollbackPrepared(tx.sources[:i]); rollbackErr != nil {
+				// the prepared branches are rolled back by Recover
+				return errors.Join(err, rollbackErr)
+			}
+			return errors.Join(err, log.Append(TxRecord{XID: tx.xid, State: TxDone}))
+		}
+	}
+
+	if err := log.Append(TxRecord{XID: tx.xid, State: TxCommitting}); err != nil {
+		return errors.Join(err, tx.rollbackPrepared(tx.sources))
+	}
+
+	var errs []error
+	for _, source := range tx.sources {
+		b := tx.branches[source]
+		if err := b.exec(ctx, b.xa.commitPrepared); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrTxInDoubt, errors.Join(errs...))
+	}
+	return log.Append(TxRecord{XID: tx.xid, State: TxDone})
+}
+
+// compactTxLog truncates the log when all transactions in it are done. It's
+// skipped when other transactions are committing, the last of them compacts it.
+func (s *Sharding) compactTxLog() {
+	if !s.txMutex.TryLock() {
+		return
+	}
+	defer s.txMutex.Unlock()
+	records, err := s.txLog.Records()
+	if err == nil && len(records) > 0 && len(pendingTxs(records)) == 0 {
+		_ = s.txLog.Truncate()
+	}
+}
+
+// Rollback rolls back all branches, none of them is prepared yet.
+func (tx *distributedTx) Rollback() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	defer tx.close()
+	tx.rollback(tx.sources...)
+	return nil
+}
+
+// rollback rolls back the branches not prepared of sources.
+func (tx *distributedTx) rollback(sources ...string) {
+	for _, source := range sources {
+		tx.branches[source].rollback(tx.ctx)
+	}
+}
+
+// rollbackPrepared rolls back the prepared branches of sources.
+func (tx *distributedTx) rollbackPrepared(sources []string) (err error) {
+	for _, source := range sources {
+		b := tx.branches[source]
+		err = errors.Join(err, b.exec(tx.ctx, b.xa.rollbackPrepared))
+	}
+	return
+}
+
+// close returns the connections of the branches to their pools.
+func (tx *distributedTx) close() {
+	for _, b := range tx.branches {
+		b.close()
+	}
+	tx.sources = nil
+	tx.branches = make(map[string]*txBranch)
+}
+
+// Recover resolves the transactions of two-phase commit not done, which are
+// left by a crash, or by ErrTxInDoubt. Their prepared branches are committed if
+// TxCommitting is logged, otherwise rolled back. It's called when the plugin is
+// initialized, and can be called at any time later, like periodically, to
+// commit the branches in doubt without a restart. It waits for the
+// transactions committing.
+func (s *Sharding) Recover(ctx context.Context) error {
+	if s.txLog == nil {
+		return nil
+	}
+	s.txMutex.Lock()
+	defer s.txMutex.Unlock()
+	records, err := s.txLog.Records()
+	if err != nil {
+		return err
+	}
+
+	prepared := make(map[string]map[string]bool)
+	for _, record := range pendingTxs(records) {
+		for i, source := range record.Sources {
+			if _, ok := prepared[source]; !ok {
+				if prepared[source], err = s.preparedXIDs(ctx, source); err != nil {
+					return err
+				}
+			}
+			xid := branchXID(record.XID, i)
+			if !prepared[source][xid] {
+				continue
+			}
+
+			xa, _ := s.sourceXA(source)
+			statement := xa.rollbackPrepared
+			if record.State == TxCommitting {
+				statement = xa.commitPrepared
+			}
+			if err = s.sourceDB(source).WithContext(ctx).Exec(strings.ReplaceAll(statement, "{xid}", xid)).Error; err != nil {
+				return err
+			}
+		}
+		if err = s.txLog.Append(TxRecord{XID: record.XID, State: TxDone}); err != nil {
+			return err
+		}
+	}
+
+	return s.txLog.Truncate()
+}
+
+// preparedXIDs returns the xids of the prepared branches on a data source.
+func (s *Sharding) preparedXIDs(ctx context.Context, source string) (map[string]bool, error) {
+	xa, err := s.sourceXA(source)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.sourceDB(source).WithContext(ctx).Raw(xa.recover).Rows()
+	if err != nil {
+		return nil, err
+	}
+	rs, err := readResultSet(rows, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	xids := make(map[string]bool, len(rs.rows))
+	for _, row := range rs.rows {
+		switch xid := row[len(row)-1].(type) {
+		case string:
+			xids[xid] = true
+		case []byte:
+			xids[string(xid)] = true
+		}
+	}
+	return xids, nil
+}
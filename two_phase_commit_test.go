@@ -0,0 +1,62 @@
+package sharding
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+	"gorm.io/gorm"
+)
+
+func TestFileTxLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tx.log")
+	log := NewFileTxLog(path)
+	records, err := log.Records()
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 0, len(records))
+
+	assert.Equal[error](t, nil, log.Append(TxRecord{XID: "a", State: TxPreparing, Sources: []string{"", "db_1"}}))
+	assert.Equal[error](t, nil, log.Append(TxRecord{XID: "b", State: TxPreparing, Sources: []string{"db_1", "db_2"}}))
+	assert.Equal[error](t, nil, log.Append(TxRecord{XID: "a", State: TxCommitting}))
+	assert.Equal[error](t, nil, log.Append(TxRecord{XID: "b", State: TxDone}))
+
+	// a record partially written by a crash
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"xid":"c","sta`)
+	f.Close()
+
+	records, err = log.Records()
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 4, len(records))
+	assert.Equal(t, []TxRecord{{XID: "a", State: TxCommitting, Sources: []string{"", "db_1"}}}, pendingTxs(records))
+
+	assert.Equal[error](t, nil, log.Truncate())
+	records, _ = log.Records()
+	assert.Equal(t, 0, len(records))
+}
+
+func TestIsolation(t *testing.T) {
+	level, err := isolation(nil)
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, "", level)
+
+	level, _ = isolation(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	assert.Equal(t, "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY", level)
+
+	_, err = isolation(&sql.TxOptions{Isolation: sql.LevelSnapshot})
+	assert.NotEqual[error](t, nil, err)
+}
+
+func TestDistributed(t *testing.T) {
+	s := Register(Config{ShardingKey: "user_id", NumberOfShards: 4}, "orders")
+	assert.Equal(t, false, s.distributed())
+
+	// a transaction can't span data sources without them
+	s.TwoPhaseCommit(NewFileTxLog(filepath.Join(t.TempDir(), "tx.log")))
+	assert.Equal(t, false, s.distributed())
+
+	s.sources = map[string]*gorm.DB{"db_1": nil}
+	assert.Equal(t, true, s.distributed())
+}
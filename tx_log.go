@@ -0,0 +1,131 @@
+package sharding
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// TxState is the state of a transaction of two-phase commit in TxLog.
+type TxState string
+
+const (
+	// TxPreparing is logged before the branches are prepared, the transaction
+	// is rolled back when it's recovered.
+	TxPreparing TxState = "preparing"
+	// TxCommitting is logged after all branches are prepared, the transaction
+	// is committed when it's recovered.
+	TxCommitting TxState = "committing"
+	// TxDone is logged after all branches are committed or rolled back.
+	TxDone TxState = "done"
+)
+
+// TxRecord is a record of TxLog.
+type TxRecord struct {
+	XID   string  `json:"xid"`
+	State TxState `json:"state"`
+	// Sources, the data sources of the branches, in order of the branch xids.
+	Sources []string `json:"sources,omitempty"`
+}
+
+// TxLog is the durable log of the transactions of two-phase commit, which the
+// in-doubt branches are resolved by after a crash.
+type TxLog interface {
+	// Append writes a record, it should be durable when Append returns.
+	Append(record TxRecord) error
+	// Records returns all records in order of appending.
+	Records() ([]TxRecord, error)
+	// Truncate removes all records, it's called when all transactions are done.
+	Truncate() error
+}
+
+// FileTxLog is a TxLog of a local file, every record is a line of JSON, and
+// synced to the disk when appended.
+type FileTxLog struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewFileTxLog returns a FileTxLog of the file of path, it's created when
+// appending the first record.
+func NewFileTxLog(path string) *FileTxLog {
+	return &FileTxLog{path: path}
+}
+
+func (l *FileTxLog) Append(record TxRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err == nil {
+		err = f.Sync()
+	}
+	return errors.Join(err, f.Close())
+}
+
+func (l *FileTxLog) Records() (records []TxRecord, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record TxRecord
+		// the last line may be partially written by a crash, the record was not durable
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func (l *FileTxLog) Truncate() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	err := os.Truncate(l.path, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// pendingTxs returns the last record of every transaction not done, in order of
+// their first records.
+func pendingTxs(records []TxRecord) []TxRecord {
+	var xids []string
+	last := make(map[string]TxRecord)
+	for _, record := range records {
+		if _, ok := last[record.XID]; !ok {
+			xids = append(xids, record.XID)
+		}
+		if len(record.Sources) == 0 {
+			record.Sources = last[record.XID].Sources
+		}
+		last[record.XID] = record
+	}
+
+	var pending []TxRecord
+	for _, xid := range xids {
+		if last[xid].State != TxDone {
+			pending = append(pending, last[xid])
+		}
+	}
+	return pending
+}
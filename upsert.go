@@ -0,0 +1,189 @@
+package sharding
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/longbridgeapp/sqlparser"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	mysqlInsertRegexp    = regexp.MustCompile(`(?is)^\s*(REPLACE|INSERT\s+IGNORE)\s+INTO\b`)
+	insertRegexp         = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\b`)
+	mysqlDuplicateRegexp = regexp.MustCompile(`(?i)\bON\s+DUPLICATE\s+KEY\s+UPDATE\b`)
+)
+
+// mysqlUpsert is the MySQL syntax of an upsert which the parser doesn't support,
+// `REPLACE INTO`, `INSERT IGNORE INTO` and `ON DUPLICATE KEY UPDATE`. They are
+// removed from the query before parsing, and added back to the rewritten queries.
+type mysqlUpsert struct {
+	// verb, `REPLACE` or `INSERT IGNORE`, empty for INSERT.
+	verb string
+	// update, the `ON DUPLICATE KEY UPDATE ...` clause.
+	update string
+	// binds, the number of bind parameters before the update clause.
+	binds int
+}
+
+// splitUpsert returns the INSERT without the MySQL upsert syntax, and the upsert
+// removed from it, nil if there is not.
+func splitUpsert(query string) (string, *mysqlUpsert) {
+	u := &mysqlUpsert{}
+	if m := mysqlInsertRegexp.FindStringSubmatchIndex(query); m != nil {
+		u.verb = strings.ToUpper(strings.Join(strings.Fields(query[m[2]:m[3]]), " "))
+		query = "INSERT INTO" + query[m[1]:]
+	}
+	if !insertRegexp.MatchString(query) {
+		return query, nil
+	}
+	for _, m := range mysqlDuplicateRegexp.FindAllStringIndex(query, -1) {
+		if !quoted(query, m[0]) {
+			u.update = query[m[0]:]
+			query = strings.TrimRight(query[:m[0]], " \t\r\n")
+			break
+		}
+	}
+	if u.verb == "" && u.update == "" {
+		return query, nil
+	}
+	return query, u
+}
+
+// restore adds the upsert syntax back to a rewritten INSERT.
+func (u *mysqlUpsert) restore(query string) string {
+	if u.verb != "" {
+		query = u.verb + strings.TrimPrefix(query, "INSERT")
+	}
+	if u.update != "" {
+		query += " " + u.update
+	}
+	return query
+}
+
+// updateArgs returns the args of the bind parameters in the update clause.
+func (u *mysqlUpsert) updateArgs(args []any) []any {
+	if u.binds >= len(args) {
+		return nil
+	}
+	return args[u.binds:]
+}
+
+// assignments returns the columns and values of the `ON DUPLICATE KEY UPDATE` assignments.
+func (u *mysqlUpsert) assignments() (columns, values []string) {
+	if u.update == "" {
+		return
+	}
+	m := mysqlDuplicateRegexp.FindStringIndex(u.update)
+	for _, assignment := range splitTopLevel(u.update[m[1]:], ',') {
+		parts := splitTopLevel(assignment, '=')
+		if len(parts) < 2 {
+			continue
+		}
+		column := strings.TrimSpace(parts[0])
+		if i := strings.LastIndex(column, "."); i >= 0 {
+			column = column[i+1:]
+		}
+		columns = append(columns, strings.Trim(column, "`\""))
+		values = append(values, strings.TrimSpace(strings.Join(parts[1:], "=")))
+	}
+	return
+}
+
+// checkUpsert returns ErrUpdateShardingKey when the update of an upsert sets
+// the sharding key other than the inserted value, the row would be in a wrong
+// sharding table.
+func checkUpsert(r Config, stmt *sqlparser.InsertStatement, u *mysqlUpsert) error {
+	keys := r.shardingKeys()
+	if c := stmt.UpsertClause; c != nil {
+		for _, a := range c.Assignments {
+			for _, column := range a.Columns {
+				if slices.Contains(keys, column.Name) && !insertedValue(a.Expr, column.Name) {
+					return ErrUpdateShardingKey
+				}
+			}
+		}
+	}
+
+	if u != nil {
+		columns, values := u.assignments()
+		for i, column := range columns {
+			if slices.Contains(keys, column) && !mysqlInsertedValue(values[i], column) {
+				return ErrUpdateShardingKey
+			}
+		}
+	}
+	return nil
+}
+
+// insertedValue returns whether expr is the inserted or the current value of
+// column in `ON CONFLICT DO UPDATE`, like `"excluded"."user_id"` or `"user_id"`.
+func insertedValue(expr sqlparser.Expr, column string) bool {
+	switch expr := expr.(type) {
+	case *sqlparser.Ident:
+		return expr.Name == column
+	case *sqlparser.QualifiedRef:
+		return expr.Column != nil && expr.Column.Name == column
+	}
+	return false
+}
+
+// mysqlInsertedValue returns whether value is the inserted or the current value
+// of column in `ON DUPLICATE KEY UPDATE`, like `VALUES(user_id)` or `new.user_id`.
+func mysqlInsertedValue(value, column string) bool {
+	value = strings.ToLower(strings.NewReplacer("`", "", " ", "").Replace(value))
+	column = strings.ToLower(column)
+	if value == column || value == "values("+column+")" {
+		return true
+	}
+	return strings.HasSuffix(value, "."+column) && !strings.ContainsAny(value, "()")
+}
+
+// splitTopLevel splits s by sep out of quotes and parentheses.
+func splitTopLevel(s string, sep byte) (parts []string) {
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		if quoted(s, i) {
+			continue
+		}
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// quoted returns whether the byte at pos of s is in a quoted string or identifier.
+func quoted(s string, pos int) bool {
+	var quote byte
+	for i := 0; i < pos; i++ {
+		switch c := s[i]; {
+		case quote == 0 && (c == '\'' || c == '"' || c == '`'):
+			quote = c
+		case quote != 0 && c == '\\' && quote != '`':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return quote != 0
+}
+
+// bindCount returns the number of bind parameters in node.
+func bindCount(node sqlparser.Node) (n int) {
+	_ = sqlparser.Walk(visitFunc(func(node sqlparser.Node) error {
+		if _, ok := node.(*sqlparser.BindExpr); ok {
+			n++
+		}
+		return nil
+	}), node)
+	return
+}
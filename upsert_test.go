@@ -0,0 +1,44 @@
+package sharding
+
+import (
+	"testing"
+
+	"github.com/longbridgeapp/assert"
+)
+
+func TestSplitUpsert(t *testing.T) {
+	query, u := splitUpsert("INSERT INTO orders (id, product) VALUES (?, ?) ON DUPLICATE KEY UPDATE product=VALUES(product)")
+	assert.Equal(t, "INSERT INTO orders (id, product) VALUES (?, ?)", query)
+	assert.Equal(t, "INSERT INTO orders_1 (id, product) VALUES (?, ?) ON DUPLICATE KEY UPDATE product=VALUES(product)", u.restore("INSERT INTO orders_1 (id, product) VALUES (?, ?)"))
+
+	query, u = splitUpsert("insert  ignore into orders (id, product) VALUES (?, ?)")
+	assert.Equal(t, "INSERT INTO orders (id, product) VALUES (?, ?)", query)
+	assert.Equal(t, "INSERT IGNORE INTO orders_1 (id)", u.restore("INSERT INTO orders_1 (id)"))
+
+	query, u = splitUpsert("INSERT INTO orders (id, product) VALUES (1, 'on duplicate key update')")
+	assert.Equal(t, "INSERT INTO orders (id, product) VALUES (1, 'on duplicate key update')", query)
+	assert.Equal(t, (*mysqlUpsert)(nil), u)
+
+	_, u = splitUpsert("SELECT * FROM orders")
+	assert.Equal(t, (*mysqlUpsert)(nil), u)
+}
+
+func TestUpsertShardingKey(t *testing.T) {
+	s := Register(Config{ShardingKey: "user_id", NumberOfShards: 4, PrimaryKeyGenerator: PKCustom, PrimaryKeyGeneratorFn: func(int64) int64 { return 0 }}, "orders")
+	assert.Equal[error](t, nil, s.compile())
+
+	_, stQueries, _, err := s.resolve(routeOptions{}, "INSERT INTO orders (id, user_id, product) VALUES (?, ?, ?), (?, ?, ?) ON DUPLICATE KEY UPDATE user_id=VALUES(user_id), product=?", 1, 101, "a", 2, 102, "b", "x")
+	assert.Equal[error](t, nil, err)
+	assert.Equal(t, 2, len(stQueries))
+	assert.Equal(t, "INSERT INTO orders_1 (id, user_id, product) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE user_id=VALUES(user_id), product=?", stQueries[0].query)
+	assert.Equal(t, []any{1, 101, "a", "x"}, stQueries[0].args)
+
+	for _, query := range []string{
+		`INSERT INTO "orders" ("id", "user_id") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "user_id" = $3`,
+		`INSERT INTO "orders" ("id", "user_id") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "user_id" = "orders"."user_id" + 1`,
+		"INSERT INTO orders (id, user_id) VALUES (?, ?) ON DUPLICATE KEY UPDATE user_id=?",
+	} {
+		_, _, _, err = s.resolve(routeOptions{}, query, 1, 101, 102)
+		assert.Equal(t, ErrUpdateShardingKey, err)
+	}
+}